@@ -37,7 +37,7 @@ const Sessions = () => {
 
     return <>
       <h1 className="font-extrabold text-2xl mb-2 flex justify-center">Sessions</h1>
-      {/* Nice table, with id, number of players (out of 2), and a join button(disabled if full)*/}
+      {/* Nice table, with id, number of players (out of max), and a join button(disabled if full)*/}
       <table className="table-fixed w-full mx-auto">
         <thead>
           <tr className="border-b">
@@ -50,11 +50,14 @@ const Sessions = () => {
           {sessions.map((session) => (
             <tr key={session.id}>
               <td className="border-b px-8 py-3">{session.id}</td>
-              <td className="border-b px-8 py-3">{session.numPlayers}/2</td>
+              <td className="border-b px-8 py-3">
+                {session.numPlayers}/{session.maxPlayers}
+                {session.numSpectators > 0 && <span className="opacity-50"> (+{session.numSpectators} watching)</span>}
+              </td>
               <td className="border-b px-8 py-3">
                 <Link
                   className="bg-primary-500 hover:bg-primary-700 text-white font-bold py-1 px-3 rounded data-[disabled=true]:opacity-50 data-[disabled=true]:pointer-events-none w-fit"
-                  data-disabled={session.numPlayers >= 2}
+                  data-disabled={session.numPlayers >= session.maxPlayers}
                   href={`/game?id=${session.id}`}
                 >
                   Join
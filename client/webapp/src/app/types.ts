@@ -1,4 +1,6 @@
 export interface Session {
     id: number
     numPlayers: number
+    maxPlayers: number
+    numSpectators: number
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Commands on the admin socket, one per line:
+//
+//	export <session id> <path> [address]  freeze the session, write its state to the path and send
+//	                                      its players to the address, where they reconnect with their token
+//	import <path>                         resume an exported session, paused until its players are back
+//	debug <session id> on|off             switch debug logging of the session
+//
+// The socket is only reachable by the user running the server
+func ListenAdmin(path string, sessions *Sessions) (net.Listener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleAdmin(sessions, conn)
+		}
+	}()
+
+	sessions.Logger.Info("Admin socket listening", "path", path)
+	return listener, nil
+}
+
+func handleAdmin(sessions *Sessions, conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		sessions.Logger.Info("Admin command", "command", scanner.Text())
+
+		switch {
+		case fields[0] == "export" && (len(fields) == 3 || len(fields) == 4):
+			id, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Fprintln(conn, "error: invalid session id")
+				continue
+			}
+
+			redirect := ""
+			if len(fields) == 4 {
+				redirect = fields[3]
+			}
+
+			// Close reasons have to fit in a control frame
+			if len(redirect) > 123 {
+				fmt.Fprintln(conn, "error: address too long")
+				continue
+			}
+
+			if err := sessions.Export(id, fields[2], redirect); err != nil {
+				fmt.Fprintln(conn, "error:", err)
+				continue
+			}
+			fmt.Fprintln(conn, "ok: exported session", id, "to", fields[2])
+		case fields[0] == "import" && len(fields) == 2:
+			id, err := sessions.Import(fields[1])
+			if err != nil {
+				fmt.Fprintln(conn, "error:", err)
+				continue
+			}
+			fmt.Fprintln(conn, "ok: imported session", id)
+		case fields[0] == "debug" && len(fields) == 3 && (fields[2] == "on" || fields[2] == "off"):
+			id, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Fprintln(conn, "error: invalid session id")
+				continue
+			}
+
+			session := sessions.Find(id, nil).Session
+			if session == nil {
+				fmt.Fprintln(conn, "error: session not found")
+				continue
+			}
+			session.LogLevel.Debug.Store(fields[2] == "on")
+			fmt.Fprintln(conn, "ok: debug logging", fields[2], "for session", id)
+		default:
+			fmt.Fprintln(conn, "error: usage: export <session id> <path> [address] | import <path> | debug <session id> on|off")
+		}
+	}
+}
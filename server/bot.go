@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"time"
 )
 
 const DEAD_ZONE = 1.0 / 3.0
@@ -29,20 +28,22 @@ func NewBotController() *BotController {
 	}
 }
 
+func (bc *BotController) OnJoin(playerId int32, session *GameSession) {}
+
 func (bc *BotController) OnUpdate(dt float32, playerId int32, session *GameSession) {
 	if session == nil {
 		return
 	}
 
-	bc.Sequence = (bc.Sequence + 1) % 256
+	bc.Sequence++
 
 	// PID controller
 	playerX := session.Players[playerId].X
 	playerY := session.Players[playerId].Y
-	targetY := PredictBallCollision(&session.Ball, playerX) - PLAYER_HEIGHT/2
-	// If ball is moving away from player, center player
-	if (playerX-session.Ball.X)/session.Ball.VelocityX < 0 {
-		targetY = float32(COURT_HEIGHT / 2)
+	targetY := session.Rules.CourtHeight / 2
+	// If every ball is moving away from player, center player
+	if ball := MostThreateningBall(session.Balls, playerX); ball != nil {
+		targetY = PredictBallCollision(ball, playerX, session.Rules.CourtHeight) - session.Players[playerId].Height/2
 	}
 
 	bc.PrevTargetY = targetY
@@ -59,7 +60,7 @@ func (bc *BotController) OnUpdate(dt float32, playerId int32, session *GameSessi
 		InputState: InputState{
 			UpPressed:   output > DEAD_ZONE,
 			DownPressed: output < -DEAD_ZONE,
-			Timestamp:   time.Now(),
+			Tick:        session.Tick + 1,
 			Sequence:    bc.Sequence,
 		},
 	}
@@ -67,7 +68,31 @@ func (bc *BotController) OnUpdate(dt float32, playerId int32, session *GameSessi
 	session.AddPlayerInput(input)
 }
 
-func PredictBallCollision(ball *Ball, hitX float32) float32 {
+// The ball moving towards the player that will get there first
+func MostThreateningBall(balls []Ball, playerX float32) *Ball {
+	var threat *Ball = nil
+	var threatTime float32 = 0
+	for i := range balls {
+		ball := &balls[i]
+		if ball.VelocityX == 0 {
+			continue
+		}
+
+		dt := (playerX - ball.X) / ball.VelocityX
+		if dt < 0 {
+			continue
+		}
+
+		if threat == nil || dt < threatTime {
+			threat = ball
+			threatTime = dt
+		}
+	}
+
+	return threat
+}
+
+func PredictBallCollision(ball *Ball, hitX float32, courtHeight float32) float32 {
 	if ball.VelocityX == 0 {
 		return ball.Y
 	}
@@ -80,9 +105,9 @@ func PredictBallCollision(ball *Ball, hitX float32) float32 {
 	y := ball.Y + ball.VelocityY*dt
 
 	if y < 0 {
-		y = -float32(math.Mod(float64(y), float64(COURT_HEIGHT)))
-	} else if y > COURT_HEIGHT {
-		y = float32(COURT_HEIGHT) - float32(math.Mod(float64(y), float64(COURT_HEIGHT)))
+		y = -float32(math.Mod(float64(y), float64(courtHeight)))
+	} else if y > courtHeight {
+		y = courtHeight - float32(math.Mod(float64(y), float64(courtHeight)))
 	}
 
 	return y
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// Time source of a GameSession, only advanced by Update
+type Clock interface {
+	Now() time.Time
+	Advance(d time.Duration)
+}
+
+// Clock that only moves when the session advances it, one tick at a time
+type TickClock struct {
+	now time.Time
+}
+
+func NewTickClock(start time.Time) *TickClock {
+	return &TickClock{
+		now: start,
+	}
+}
+
+func (tc *TickClock) Now() time.Time {
+	return tc.now
+}
+
+func (tc *TickClock) Advance(d time.Duration) {
+	tc.now = tc.now.Add(d)
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
-	"encoding/binary"
-	"fmt"
+	"log/slog"
 	"math"
-	mathrand "math/rand"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // 60 Hz
@@ -17,6 +18,7 @@ const BALL_SPEED = 175
 const MAX_BALL_SPEED_FACTOR = 10
 const BALL_SPEED_RATE = 1.018
 const BALL_RADIUS = 10
+const MAX_BALLS = 8
 
 const ATTACK_DIRECTION = math.Pi / 12
 const ATTACK_SPEED_FACTOR = 2
@@ -24,11 +26,19 @@ const ATTACK_SPEED_FACTOR = 2
 const COURT_WIDTH = 800
 const COURT_HEIGHT = 600
 
-const MAX_PLAYERS = 2
+const MAX_TEAM_SIZE = 2
+const MAX_PLAYERS = 2 * MAX_TEAM_SIZE
+
+// In doubles the front paddles stand a quarter of the court in from the back paddles
+const FRONT_COLUMN_OFFSET = 0.25
 
 const GAME_SCORE_LIMIT = 11
 const GAME_SCORE_DIFFERENCE = 2
 
+// Sessions nobody joins, or that only bots are waiting in, end after this long
+const WAITING_TIMEOUT = time.Minute
+const WAITING_TIMEOUT_TICKS = uint32(WAITING_TIMEOUT / SESSION_DELTA_TIME)
+
 const GAME_RESET_TIME = 5 * time.Second
 const ROUND_RESET_TIME = 750 * time.Millisecond
 
@@ -44,40 +54,98 @@ const (
 	Running
 	InBetweenRounds
 	GameOver
+	Paused // Waiting for a dropped player to reconnect
 )
 
 type Ball struct {
+	Id        uint32
 	X         float32
 	Y         float32
 	VelocityX float32
 	VelocityY float32
+	LastHitBy int32
+	OutTick   uint32 // Tick the ball left the court, while the goal waits for rewound hits
+	Curve     float32
 }
 
 // Events that happened during the frame
 type FrameEvents struct {
-	BallCollided   bool
-	BallHitPlayer  bool
-	BallWasSmashed bool
-	NewRound       bool
+	BallCollided     bool
+	BallHitPlayer    bool
+	BallWasSmashed   bool
+	NewRound         bool
+	BallSpawned      bool
+	PowerUpSpawned   bool
+	PowerUpCollected bool
+	ShieldUsed       bool
 }
 
 type GameSession struct {
 	Id           int
+	Seed         int64
+	Rules        Rules
+	Rand         Rng
+	Clock        Clock
+	Tick         uint32
 	Players      map[int32]*Player
-	Ball         Ball
+	Slots        [MAX_PLAYERS]*Player
+	Scores       [2]int32
+	Balls        []Ball
+	NextBallId   uint32
+	SpawnTime    time.Duration
+	PowerUps     []PowerUp
+	PowerUpTime  time.Duration
 	Time         time.Duration
 	State        GameState
 	ShouldUpdate bool
 	Sessions     *Sessions
 	Events       FrameEvents
 
-	StateBuffer bytes.Buffer
-
-	RegisterPlayer   chan *Player
-	UnregisterPlayer chan *Player
-	RegisterInput    chan InputUpdate
-
-	PauseTimer *time.Timer
+	// State to go back to once every held seat is taken again
+	PausedState        GameState
+	PausedShouldUpdate bool
+
+	// Recent snapshots and the deltas of the current one, keyed by base tick
+	Snapshots   SnapshotHistory
+	LagHistory  LagHistory
+	Rollbacks   RollbackHistory
+	RollbackTo  uint32 // Oldest tick late inputs arrived for since the last step, zero if none
+	deltas      map[uint32][]byte
+	frameBuffer []byte
+
+	Spectators map[*Spectator]bool
+
+	RegisterPlayer      chan *Player
+	UnregisterPlayer    chan *Player
+	RegisterInput       chan InputUpdate
+	RegisterSpectator   chan *Spectator
+	UnregisterSpectator chan *Spectator
+	DisconnectPlayer    chan Disconnect
+	ReconnectPlayer     chan ReconnectRequest
+	Summarize           chan chan SessionSummary
+	Export              chan ExportRequest
+
+	// Closed once the session has stopped running
+	Done chan struct{}
+
+	// Tick of the session for the goroutines reading the connections, stored after every step
+	LatestTick atomic.Uint32
+
+	// Close frame the session ended with, for clients that did not make it in. Set before Done is closed
+	CloseMessage []byte
+
+	// Ticks left until the pause ends, counted by Advance so pauses are part of the simulation
+	PauseTicks uint32
+	IdleTicks  uint32 // Ticks spent waiting for players without a human connected
+	Recorder   *ReplayRecorder
+	Imported   bool // Resumed from the export of another server, which keeps the replay
+
+	// Observed by Run, read when the metrics are scraped
+	TickDurations *Histogram
+
+	// Carries the session id, debug logging can be switched on for the session while it runs
+	Logger   *slog.Logger
+	LogLevel SessionLevel
 }
 
 func Clamp(f float32, min float32, max float32) float32 {
@@ -91,91 +159,194 @@ func Clamp(f float32, min float32, max float32) float32 {
 	return f
 }
 
-func NewBall() Ball {
+func NewBall(rng *Rng, rules *Rules) Ball {
 	return Ball{
-		X:         float32(COURT_WIDTH / 2),
-		Y:         float32((COURT_HEIGHT-2*BALL_RADIUS)*mathrand.Float32() + BALL_RADIUS),
-		VelocityX: BALL_SPEED * float32(INV_SQRT_2) * float32(mathrand.Intn(2)*2-1),
-		VelocityY: BALL_SPEED * float32(INV_SQRT_2) * float32(mathrand.Intn(2)*2-1),
+		X:         rules.CourtWidth / 2,
+		Y:         (rules.CourtHeight-2*BALL_RADIUS)*rng.Float32() + BALL_RADIUS,
+		VelocityX: rules.BallSpeed * float32(INV_SQRT_2) * float32(rng.Intn(2)*2-1),
+		VelocityY: rules.BallSpeed * float32(INV_SQRT_2) * float32(rng.Intn(2)*2-1),
 	}
 }
 
-func NewGameSession(id int) *GameSession {
-	return &GameSession{
+// Same seed and same inputs give the same match, the clock starts at wall time
+// but is only advanced by Update
+func NewGameSession(id int, seed int64, rules Rules) *GameSession {
+	gs := &GameSession{
 		Id:           id,
+		Seed:         seed,
+		Rules:        rules,
+		Rand:         NewRng(seed),
+		Clock:        NewTickClock(time.Now()),
 		Players:      make(map[int32]*Player),
-		Ball:         NewBall(),
 		Time:         0,
 		ShouldUpdate: false,
 		State:        WaitingForPlayers,
 		Events:       FrameEvents{},
 
-		RegisterPlayer:   make(chan *Player, 1),
-		UnregisterPlayer: make(chan *Player, 1),
-		RegisterInput:    make(chan InputUpdate, 1),
+		deltas: make(map[uint32][]byte),
+
+		Spectators: make(map[*Spectator]bool),
+
+		RegisterPlayer:      make(chan *Player, 1),
+		UnregisterPlayer:    make(chan *Player, 1),
+		RegisterInput:       make(chan InputUpdate, 1),
+		RegisterSpectator:   make(chan *Spectator, 1),
+		UnregisterSpectator: make(chan *Spectator, 1),
+		DisconnectPlayer:    make(chan Disconnect, 1),
+		ReconnectPlayer:     make(chan ReconnectRequest, 1),
+		Summarize:           make(chan chan SessionSummary),
+		Export:              make(chan ExportRequest),
+
+		TickDurations: NewHistogram(TICK_DURATION_BUCKETS),
 
-		PauseTimer: time.NewTimer(0),
+		Done: make(chan struct{}),
 	}
 
+	gs.Logger = NewSessionLogger(id, &gs.LogLevel)
+	gs.Balls = []Ball{gs.NewBall()}
+	return gs
+}
+
+// Balls get an id so the lag history can follow them across ticks
+func (gs *GameSession) NewBall() Ball {
+	gs.NextBallId++
+	ball := NewBall(&gs.Rand, &gs.Rules)
+	ball.Id = gs.NextBallId
+	return ball
 }
 
 func (gs *GameSession) AddPlayer(player *Player) {
 	_, isBot := player.Controller.(*BotController)
 
 	// Check if session is full
-	if len(gs.Players) >= MAX_PLAYERS {
+	if len(gs.Players) >= gs.Rules.MaxPlayers() {
 		if !isBot {
 			player.Ready <- false
 		}
 		return
 	}
 
-	// Generate random id using rand package
-	b := make([]byte, 4)
-	rand.Read(b)
-	player.Id = int32(b[0])<<24 | int32(b[1])<<16 | int32(b[2])<<8 | int32(b[3])
+	// Generate random id using rand package, unless replaying a known player
+	if player.Id == 0 {
+		b := make([]byte, 4)
+		rand.Read(b)
+		player.Id = int32(b[0])<<24 | int32(b[1])<<16 | int32(b[2])<<8 | int32(b[3])
+	}
 
-	// Check if other player is on the left or right
-	if len(gs.Players) == 1 {
-		for _, otherPlayer := range gs.Players {
-			if otherPlayer.X < float32(COURT_WIDTH/2) {
-				player.X = float32(COURT_WIDTH - PLAYER_WIDTH)
-			} else {
-				player.X = 0
-			}
+	if _, ok := player.Controller.(*PlayerController); ok {
+		player.Token = NewReconnectToken()
+	}
+
+	// Take the first free slot, which keeps the teams even and fills the back columns first
+	for slot := 0; slot < gs.Rules.MaxPlayers(); slot++ {
+		if gs.Slots[slot] == nil {
+			player.Slot = slot
+			break
 		}
-	} else {
-		player.X = 0
 	}
 
-	player.Y = float32(COURT_HEIGHT/2 - PLAYER_HEIGHT/2)
+	gs.Slots[player.Slot] = player
+	player.Team = SlotSide(player.Slot)
+	player.X = gs.ColumnX(player.Team, player.Slot >= 2)
+
+	player.Width = gs.Rules.PlayerWidth
+	player.Height = gs.Rules.PlayerHeight
+	player.Y = gs.Rules.CourtHeight/2 - player.Height/2
 
 	// Add player to session
 	gs.Players[player.Id] = player
+	gs.Recorder.RecordJoin(gs.Tick, player.Id, isBot)
 	if !isBot {
 		player.Ready <- true
 	}
 
-	fmt.Println("Player added")
+	player.Controller.OnJoin(player.Id, gs)
+
+	gs.Log().Info("Player added", "player", player.Id, "slot", player.Slot, "bot", isBot)
+}
+
+// Slots alternate between the left and the right side, back column first
+func SlotSide(slot int) uint8 {
+	return uint8(slot % 2)
+}
+
+// X position of a paddle, the left team defends X = 0 and the right team the far end
+func (gs *GameSession) ColumnX(team uint8, front bool) float32 {
+	var offset float32 = 0
+	if front {
+		offset = gs.Rules.CourtWidth * FRONT_COLUMN_OFFSET
+	}
+
+	if team == 0 {
+		return offset
+	}
+
+	return gs.Rules.CourtWidth - gs.Rules.PlayerWidth - offset
 }
 
 func (gs *GameSession) RemovePlayer(player *Player) {
 	delete(gs.Players, player.Id)
-	fmt.Println("Player removed")
+	if gs.Slots[player.Slot] == player {
+		gs.Slots[player.Slot] = nil
+	}
+	gs.Recorder.RecordLeave(gs.Tick, player.Id)
+	gs.Log().Info("Player removed", "player", player.Id)
+}
+
+func (gs *GameSession) AddSpectator(spectator *Spectator) {
+	gs.Spectators[spectator] = true
+	spectator.Controller.OnJoin(0, gs)
+	gs.Log().Info("Spectator added", "spectators", len(gs.Spectators))
+}
+
+func (gs *GameSession) RemoveSpectator(spectator *Spectator) {
+	delete(gs.Spectators, spectator)
+	gs.Log().Info("Spectator removed", "spectators", len(gs.Spectators))
 }
 
 func (gs *GameSession) AddPlayerInput(inputUpdate InputUpdate) {
-	if !gs.ShouldUpdate {
+	player, ok := gs.Players[inputUpdate.PlayerId]
+	if !ok {
+		gs.Log().Warn("Input for unknown player", "player", inputUpdate.PlayerId)
 		return
 	}
 
-	player, ok := gs.Players[inputUpdate.PlayerId]
-	if !ok {
-		fmt.Println("Player not found")
+	// Sequences only count up, anything else is a duplicate or arrived out of order
+	if inputUpdate.InputState.Sequence <= player.ReceivedSequence {
 		return
 	}
+	player.ReceivedSequence = inputUpdate.InputState.Sequence
+
+	// A newer input never applies before an older one, so the acknowledged sequence only counts up
+	tick := min(inputUpdate.InputState.Tick, gs.Tick+MAX_INPUT_LEAD_TICKS)
+	if count := len(player.InputStates); count > 0 {
+		tick = max(tick, player.InputStates[count-1].Tick)
+	}
+
+	// Late inputs apply on the next tick, unless the session can roll back to the tick they were meant for
+	late := gs.CanRollback(tick)
+	if !late {
+		if !gs.ShouldUpdate {
+			return
+		}
+		tick = max(tick, gs.Tick+1)
+	}
+	inputUpdate.InputState.Tick = tick
+
+	// The tick the client had seen when sending the input, never ahead of the session
+	if ackTick := inputUpdate.InputState.AckTick; ackTick > player.ViewTick && ackTick <= gs.Tick {
+		player.ViewTick = ackTick
+	}
 
+	// Ticks never go down, so the inputs stay in tick and sequence order
 	player.InputStates = append(player.InputStates, inputUpdate.InputState)
+
+	gs.Recorder.RecordInput(gs.Tick, inputUpdate)
+
+	// Rolled back once before the next tick, however many late inputs arrive in between
+	if late && (gs.RollbackTo == 0 || tick < gs.RollbackTo) {
+		gs.RollbackTo = tick
+	}
 }
 
 func (gs *GameSession) BeginGame() {
@@ -183,13 +354,57 @@ func (gs *GameSession) BeginGame() {
 	gs.PauseGame(GAME_RESET_TIME)
 }
 
+// The result is rated once the game over pause ends, when a rollback can no longer change it
 func (gs *GameSession) EndGame() {
 	gs.State = GameOver
 	gs.PauseGame(GAME_RESET_TIME)
 }
 
+// Updates the ratings of the winner and loser, games with bots, guests or doubles are not rated
+func (gs *GameSession) RateGame() {
+	if gs.Sessions == nil || gs.Sessions.Profiles == nil || len(gs.Players) != 2 {
+		return
+	}
+
+	var winner, loser *Player = nil, nil
+	for _, player := range gs.Players {
+		if gs.Scores[player.Team] > gs.Scores[1-player.Team] {
+			winner = player
+		} else {
+			loser = player
+		}
+	}
+
+	if winner == nil || loser == nil {
+		return
+	}
+
+	if winner.ProfileId == "" || loser.ProfileId == "" {
+		return
+	}
+
+	if err := gs.Sessions.Profiles.RecordMatch(winner.ProfileId, loser.ProfileId); err != nil {
+		gs.Log().Error("Could not rate game", "error", err)
+	}
+}
+
+func (gs *GameSession) FinishGame() {
+	gs.RateGame()
+	gs.CountGame("finished")
+}
+
+// Checks if a game is under way and not over yet, also while seats are held
+func (gs *GameSession) InGame() bool {
+	state := gs.State
+	if state == Paused {
+		state = gs.PausedState
+	}
+
+	return state == Starting || state == Running || state == InBetweenRounds
+}
+
 func (gs *GameSession) InterruptGame() {
-	gs.PauseTimer.Stop()
+	gs.PauseTicks = 0
 	gs.State = WaitingForPlayers
 	gs.ShouldUpdate = false
 	gs.ResetGame()
@@ -207,28 +422,28 @@ func (gs *GameSession) EndRound() {
 func (gs *GameSession) ResetGame() {
 
 	gs.ResetRound()
-
-	for _, player := range gs.Players {
-		player.Score = 0
-	}
+	gs.Scores = [2]int32{}
 }
 
 func (gs *GameSession) ResetRound() {
-	// Reset ball position
-	gs.Ball.X = float32(COURT_WIDTH / 2)
-	gs.Ball.Y = float32((COURT_HEIGHT-2*BALL_RADIUS)*mathrand.Float32() + BALL_RADIUS)
-
-	// Reset ball velocity
-	gs.Ball.VelocityX = BALL_SPEED * float32(INV_SQRT_2) * float32(mathrand.Intn(2)*2-1)
-	gs.Ball.VelocityY = BALL_SPEED * float32(INV_SQRT_2) * float32(mathrand.Intn(2)*2-1)
+	// Reset ball position and velocity
+	gs.Balls = []Ball{gs.NewBall()}
+	gs.SpawnTime = 0
+	gs.PowerUps = gs.PowerUps[:0]
+	gs.PowerUpTime = 0
 
 	// Reset time
 	gs.Time = 0
 
 	// Reset player positions
 	for _, player := range gs.Players {
-		player.Y = float32(COURT_HEIGHT/2 - PLAYER_HEIGHT/2)
-		player.InputStates = make([]InputState, 0)
+		player.Effects = player.Effects[:0]
+		player.Shield = false
+		player.Height = gs.Rules.PlayerHeight
+		player.Y = gs.Rules.CourtHeight/2 - player.Height/2
+		player.InputStates = player.InputStates[:0]
+		player.Input.UpPressed = false
+		player.Input.DownPressed = false
 	}
 
 	gs.Events.NewRound = true
@@ -236,15 +451,158 @@ func (gs *GameSession) ResetRound() {
 
 func (gs *GameSession) PauseGame(duration time.Duration) {
 	gs.ShouldUpdate = false
-	gs.PauseTimer.Reset(duration)
+	gs.PauseTicks = max(uint32(duration/SESSION_DELTA_TIME), 1)
+}
+
+// Where along the ball's path it hit a paddle, as a fraction of the frame, and the surface normal
+type Collision struct {
+	Time    float32
+	NormalX float32
+	NormalY float32
+}
+
+// Sweeps the ball from oldBall to ball against the player paddle expanded by the ball radius,
+// rounded corners included, so fast balls can not tunnel through it
+func IsColliding(oldBall *Ball, ball *Ball, player *Player) (Collision, bool) {
+	minX := player.X - BALL_RADIUS
+	maxX := player.X + player.Width + BALL_RADIUS
+	minY := player.Y - BALL_RADIUS
+	maxY := player.Y + player.Height + BALL_RADIUS
+
+	dx := ball.X - oldBall.X
+	dy := ball.Y - oldBall.Y
+
+	// Already overlapping, push the ball out horizontally
+	closestX := Clamp(oldBall.X, player.X, player.X+player.Width)
+	closestY := Clamp(oldBall.Y, player.Y, player.Y+player.Height)
+	if (oldBall.X-closestX)*(oldBall.X-closestX)+(oldBall.Y-closestY)*(oldBall.Y-closestY) < BALL_RADIUS*BALL_RADIUS {
+		normalX := float32(1.0)
+		if oldBall.X < player.X+player.Width/2 {
+			normalX = -1.0
+		}
+		return Collision{Time: 0, NormalX: normalX, NormalY: 0}, true
+	}
+
+	// Slab test against the expanded rectangle
+	tEnter := float32(0)
+	tExit := float32(1)
+	var normalX, normalY float32 = 0, 0
+
+	for axis := 0; axis < 2; axis++ {
+		origin, delta, lo, hi := oldBall.X, dx, minX, maxX
+		if axis == 1 {
+			origin, delta, lo, hi = oldBall.Y, dy, minY, maxY
+		}
+
+		if delta == 0 {
+			if origin <= lo || origin >= hi {
+				return Collision{}, false
+			}
+			continue
+		}
+
+		t0 := (lo - origin) / delta
+		t1 := (hi - origin) / delta
+		sign := float32(-1.0)
+		if t0 > t1 {
+			t0, t1 = t1, t0
+			sign = 1.0
+		}
+
+		if t0 > tEnter {
+			tEnter = t0
+			normalX, normalY = 0, 0
+			if axis == 0 {
+				normalX = sign
+			} else {
+				normalY = sign
+			}
+		}
+
+		if t1 < tExit {
+			tExit = t1
+		}
+
+		if tEnter > tExit {
+			return Collision{}, false
+		}
+	}
+
+	hitX := oldBall.X + dx*tEnter
+	hitY := oldBall.Y + dy*tEnter
+
+	// Hit one of the faces
+	if (hitX >= player.X && hitX <= player.X+player.Width) || (hitY >= player.Y && hitY <= player.Y+player.Height) {
+		return Collision{Time: tEnter, NormalX: normalX, NormalY: normalY}, true
+	}
+
+	// Hit the expanded corner region, test against the circle around the corner instead
+	cornerX := Clamp(hitX, player.X, player.X+player.Width)
+	cornerY := Clamp(hitY, player.Y, player.Y+player.Height)
+
+	ox := oldBall.X - cornerX
+	oy := oldBall.Y - cornerY
+	a := dx*dx + dy*dy
+	b := 2 * (ox*dx + oy*dy)
+	c := ox*ox + oy*oy - BALL_RADIUS*BALL_RADIUS
+	discriminant := b*b - 4*a*c
+	if a == 0 || discriminant < 0 {
+		return Collision{}, false
+	}
+
+	t := (-b - float32(math.Sqrt(float64(discriminant)))) / (2 * a)
+	if t < 0 || t > 1 {
+		return Collision{}, false
+	}
+
+	return Collision{
+		Time:    t,
+		NormalX: (ox + dx*t) / BALL_RADIUS,
+		NormalY: (oy + dy*t) / BALL_RADIUS,
+	}, true
 }
 
-func IsColliding(oldBall *Ball, ball *Ball, player *Player) bool {
-	directCollision := (ball.X-BALL_RADIUS < player.X+PLAYER_WIDTH) && (ball.X+BALL_RADIUS > player.X) && (ball.Y-BALL_RADIUS < player.Y+PLAYER_HEIGHT) && (ball.Y+BALL_RADIUS > player.Y)
+// Moves the ball to the point of impact and bounces it off the player paddle
+func (gs *GameSession) HitBall(ball *Ball, oldBall *Ball, player *Player, hit Collision) {
+	ball.X = oldBall.X + (ball.X-oldBall.X)*hit.Time
+	ball.Y = oldBall.Y + (ball.Y-oldBall.Y)*hit.Time
 
-	// Could add some better collision detection here...
+	// Reflect velocity around the normal
+	dot := ball.VelocityX*hit.NormalX + ball.VelocityY*hit.NormalY
+	ball.VelocityX -= 2 * dot * hit.NormalX
+	ball.VelocityY -= 2 * dot * hit.NormalY
 
-	return directCollision
+	ball.LastHitBy = player.Id
+	ball.Curve = 0
+
+	gs.Events.BallCollided = true
+	gs.Events.BallHitPlayer = true
+
+	// If player was moving, change ball direction
+	lastInputState := player.Input
+	if lastInputState.UpPressed == lastInputState.DownPressed {
+		return
+	}
+
+	gs.Events.BallWasSmashed = true
+
+	speedMagnitude := math.Sqrt(float64(ball.VelocityX*ball.VelocityX+ball.VelocityY*ball.VelocityY)) * ATTACK_SPEED_FACTOR
+	speedMagnitude = math.Min(speedMagnitude, float64(gs.Rules.BallSpeed*gs.Rules.MaxBallSpeedFactor))
+	var xSign float32 = 1.0
+	if ball.VelocityX < 0 {
+		xSign = -1.0
+	}
+
+	var angle float64 = 0
+
+	if lastInputState.UpPressed {
+		angle = -ATTACK_DIRECTION
+	} else {
+		angle = ATTACK_DIRECTION
+	}
+
+	ball.VelocityY = float32(speedMagnitude * math.Sin(angle))
+	ball.VelocityX = float32(speedMagnitude*math.Cos(angle)) * xSign
 }
 
 func (gs *GameSession) Update(dt time.Duration) {
@@ -252,306 +610,491 @@ func (gs *GameSession) Update(dt time.Duration) {
 	// Reset events
 	gs.Events = FrameEvents{}
 
+	// The clock keeps running while paused, so input timestamps stay comparable
+	gs.Clock.Advance(dt)
+
 	if !gs.ShouldUpdate {
 		return
 	}
 
 	gs.Time += dt
-	now := time.Now()
-	// Replay all inputs, integrating player positions
+	// Apply the last input due by this tick and move the paddles by the held input.
+	// Rollback sessions keep applied inputs around, to simulate the window again
 	for _, player := range gs.Players {
-		// Take into consideration the time since the last update
-		integrated := player.Y
-		for i := 0; i < len(player.InputStates); i++ {
-			inputState := player.InputStates[i]
-			inputDelta := time.Duration(0)
-			if i == len(player.InputStates)-1 {
-				inputDelta = now.Sub(inputState.Timestamp)
-			} else {
-				nextInputState := player.InputStates[i+1]
-				inputDelta = nextInputState.Timestamp.Sub(inputState.Timestamp)
-			}
-
-			// Integrate
-			if inputState.UpPressed {
-				integrated -= PLAYER_SPEED * float32(inputDelta.Seconds())
-			}
-			if inputState.DownPressed {
-				integrated += PLAYER_SPEED * float32(inputDelta.Seconds())
-			}
+		due := 0
+		for due < len(player.InputStates) && player.InputStates[due].Tick <= gs.Tick {
+			due++
 		}
 
-		// Check for collisions
-		if integrated < 0 {
-			integrated = 0
+		if due > 0 {
+			player.Input = player.InputStates[due-1]
 		}
 
-		if integrated > float32(COURT_HEIGHT-PLAYER_HEIGHT) {
-			integrated = float32(COURT_HEIGHT - PLAYER_HEIGHT)
+		applied := due
+		if gs.Rules.Rollback {
+			applied = 0
+			for applied < due && player.InputStates[applied].Tick+ROLLBACK_WINDOW <= gs.Tick {
+				applied++
+			}
 		}
+		player.InputStates = append(player.InputStates[:0], player.InputStates[applied:]...)
 
-		// Update player position
-		player.Y = integrated
-
-		// Remove everything except the last input state
-		if len(player.InputStates) > 1 {
-			player.InputStates = player.InputStates[len(player.InputStates)-1:]
+		integrated := player.Y
+		if player.Input.UpPressed {
+			integrated -= gs.Rules.PlayerSpeed * float32(dt.Seconds())
+		}
+		if player.Input.DownPressed {
+			integrated += gs.Rules.PlayerSpeed * float32(dt.Seconds())
 		}
-	}
-
-	// Cache old ball state
-	oldBall := gs.Ball
 
-	// Update ball position
-	velocityScale := float32(math.Pow(BALL_SPEED_RATE, float64(gs.Time.Seconds())))
-	if velocityScale > MAX_BALL_SPEED_FACTOR {
-		velocityScale = MAX_BALL_SPEED_FACTOR
+		player.Y = Clamp(integrated, 0, gs.Rules.CourtHeight-player.Height)
 	}
 
-	gs.Ball.X = Clamp(gs.Ball.X+gs.Ball.VelocityX*float32(dt.Seconds())*velocityScale, -BALL_RADIUS, float32(COURT_WIDTH+BALL_RADIUS))
-	gs.Ball.Y = Clamp(gs.Ball.Y+gs.Ball.VelocityY*float32(dt.Seconds())*velocityScale, -BALL_RADIUS, float32(COURT_HEIGHT+BALL_RADIUS))
+	gs.UpdatePowerUps(dt)
 
-	// Check for collisions
-	if gs.Ball.Y < BALL_RADIUS {
-		gs.Ball.Y = BALL_RADIUS
-		gs.Ball.VelocityY *= -1
-		gs.Events.BallCollided = true
+	// Update ball positions
+	velocityScale := float32(math.Pow(float64(gs.Rules.BallSpeedRate), float64(gs.Time.Seconds())))
+	if velocityScale > gs.Rules.MaxBallSpeedFactor {
+		velocityScale = gs.Rules.MaxBallSpeedFactor
 	}
 
-	if gs.Ball.Y > float32(COURT_HEIGHT-BALL_RADIUS) {
-		gs.Ball.Y = float32(COURT_HEIGHT - BALL_RADIUS)
-		gs.Ball.VelocityY *= -1
-		gs.Events.BallCollided = true
+	frameTime := float32(dt.Seconds()) * velocityScale
+	for i := range gs.Balls {
+		oldBall := gs.Balls[i]
+		gs.MoveBall(&gs.Balls[i], frameTime)
+		gs.CollectPowerUps(&oldBall, &gs.Balls[i])
 	}
 
-	// Check for player collisions
-	for _, player := range gs.Players {
-		// Test collision with ball radius taken into account
-		if !IsColliding(&oldBall, &gs.Ball, player) {
+	gs.LagHistory.Record(gs)
+
+	// Balls leaving the court score for the team defending the other goal
+	inPlay := gs.Balls[:0]
+	gameOver := false
+	for _, ball := range gs.Balls {
+		if ball.X >= 0 && ball.X <= gs.Rules.CourtWidth {
+			ball.OutTick = 0
+			inPlay = append(inPlay, ball)
 			continue
 		}
 
-		gs.Ball.VelocityX *= -1
-		gs.Events.BallCollided = true
-		gs.Events.BallHitPlayer = true
+		var scoringTeam uint8 = 0
+		if ball.X < 0 {
+			scoringTeam = 1
+		}
 
-		// Move ball outside player
-		if gs.Ball.X > COURT_WIDTH/2 {
-			gs.Ball.X = player.X - BALL_RADIUS
-		} else {
-			gs.Ball.X = player.X + PLAYER_WIDTH + BALL_RADIUS
+		// A defender with a slow connection may have seen the ball hit its paddle, and its input
+		// can take a round trip to arrive, so the goal waits for the rewind window
+		if ball.OutTick == 0 {
+			ball.OutTick = gs.Tick
 		}
 
-		// If player was moving, change ball direction
-		if len(player.InputStates) == 0 {
+		if gs.CanRewind(1-scoringTeam) && gs.RewindHit(&ball, 1-scoringTeam, frameTime) {
+			inPlay = append(inPlay, ball)
 			continue
 		}
 
-		lastInputState := player.InputStates[len(player.InputStates)-1]
-		if lastInputState.UpPressed == lastInputState.DownPressed {
+		if gs.UseShield(&ball, 1-scoringTeam) {
+			inPlay = append(inPlay, ball)
 			continue
 		}
 
-		gs.Events.BallWasSmashed = true
+		if gs.CanRewind(1 - scoringTeam) {
+			if gs.Tick-ball.OutTick < MAX_REWIND_TICKS {
+				inPlay = append(inPlay, ball)
+				continue
+			}
 
-		speedMagnitude := math.Sqrt(float64(gs.Ball.VelocityX*gs.Ball.VelocityX+gs.Ball.VelocityY*gs.Ball.VelocityY)) * ATTACK_SPEED_FACTOR
-		speedMagnitude = math.Min(speedMagnitude, BALL_SPEED*MAX_BALL_SPEED_FACTOR)
-		var xSign float32 = 1.0
-		if gs.Ball.VelocityX < 0 {
-			xSign = -1.0
+			gs.Log().Info("Goal stands after rewinding", "team", 1-scoringTeam, "ticks", MAX_REWIND_TICKS)
 		}
 
-		var angle float64 = 0
+		gs.Scores[scoringTeam]++
 
-		if lastInputState.UpPressed {
-			angle = -ATTACK_DIRECTION
-		} else {
-			angle = ATTACK_DIRECTION
+		// Check if game is over
+		score := gs.Scores[scoringTeam]
+		if score >= gs.Rules.ScoreLimit && (score-gs.Scores[1-scoringTeam]) >= gs.Rules.ScoreDifference {
+			gameOver = true
 		}
+	}
+	gs.Balls = inPlay
 
-		gs.Ball.VelocityY = float32(speedMagnitude * math.Sin(angle))
-		gs.Ball.VelocityX = float32(speedMagnitude*math.Cos(angle)) * xSign
+	if gameOver {
+		gs.EndGame()
+		return
+	}
 
+	if len(gs.Balls) == 0 {
+		gs.EndRound()
+		return
 	}
 
-	// Check if ball is out of bounds, then which player is furthest away
-	if gs.Ball.X < 0 || gs.Ball.X > float32(COURT_WIDTH) {
-		// Find player furthest away from ball
-		var furthestPlayer *Player = nil
-		for _, player := range gs.Players {
-			if furthestPlayer == nil {
-				furthestPlayer = player
-			} else {
-				if float32(math.Abs(float64(player.X-gs.Ball.X))) > float32(math.Abs(float64(furthestPlayer.X-gs.Ball.X))) {
-					furthestPlayer = player
-				}
-			}
-		}
+	// Extra balls come in on a timer or when someone smashes
+	gs.SpawnTime += dt
+	if gs.Rules.BallSpawnInterval > 0 && gs.SpawnTime.Seconds() >= float64(gs.Rules.BallSpawnInterval) {
+		gs.SpawnTime = 0
+		gs.SpawnBall()
+	}
+
+	if gs.Rules.SpawnOnSmash && gs.Events.BallWasSmashed {
+		gs.SpawnBall()
+	}
+}
+
+func (gs *GameSession) SpawnBall() {
+	if len(gs.Balls) >= int(gs.Rules.MaxBalls) {
+		return
+	}
+
+	gs.Balls = append(gs.Balls, gs.NewBall())
+	gs.Events.BallSpawned = true
+}
 
-		// Increment furthest player score
-		furthestPlayer.Score++
+// Moves a ball for one frame, bouncing it off paddles and walls
+func (gs *GameSession) MoveBall(ball *Ball, frameTime float32) {
+	// Cache old ball state
+	oldBall := *ball
 
-		highestScore := int32(0)
-		nextHighestScore := int32(0)
+	ball.VelocityY += ball.Curve * frameTime
+	ball.X += ball.VelocityX * frameTime
+	ball.Y += ball.VelocityY * frameTime
 
-		for _, player := range gs.Players {
-			if player.Score > highestScore {
-				nextHighestScore = highestScore
-				highestScore = player.Score
-			}
+	// Find the first paddle the ball hits during the frame
+	var hitPlayer *Player = nil
+	var hit Collision
+	for _, player := range gs.Players {
+		collision, ok := IsColliding(&oldBall, ball, player)
+		if !ok {
+			continue
 		}
 
-		// Check if game is over
-		if highestScore >= GAME_SCORE_LIMIT && (highestScore-nextHighestScore) >= GAME_SCORE_DIFFERENCE {
-			gs.EndGame()
-		} else {
-			gs.EndRound()
+		// Ignore paddles the ball is already moving away from
+		if ball.VelocityX*collision.NormalX+ball.VelocityY*collision.NormalY >= 0 {
+			continue
+		}
+
+		// Paddles only block balls heading for their own goal, so teammates never send it back
+		if (player.Team == 0 && ball.VelocityX > 0) || (player.Team == 1 && ball.VelocityX < 0) {
+			continue
+		}
+
+		if hitPlayer == nil || collision.Time < hit.Time {
+			hitPlayer = player
+			hit = collision
 		}
 	}
 
+	if hitPlayer != nil {
+		gs.HitBall(ball, &oldBall, hitPlayer, hit)
+
+		// Spend the rest of the frame moving in the new direction
+		remaining := (1 - hit.Time) * frameTime
+		ball.X += ball.VelocityX * remaining
+		ball.Y += ball.VelocityY * remaining
+	}
+
+	ball.X = Clamp(ball.X, -BALL_RADIUS, gs.Rules.CourtWidth+BALL_RADIUS)
+	ball.Y = Clamp(ball.Y, -BALL_RADIUS, gs.Rules.CourtHeight+BALL_RADIUS)
+
+	// Check for collisions
+	if ball.Y < BALL_RADIUS {
+		ball.Y = BALL_RADIUS
+		ball.VelocityY *= -1
+		gs.Events.BallCollided = true
+	}
+
+	if ball.Y > gs.Rules.CourtHeight-BALL_RADIUS {
+		ball.Y = gs.Rules.CourtHeight - BALL_RADIUS
+		ball.VelocityY *= -1
+		gs.Events.BallCollided = true
+	}
 }
 
 func (gs *GameSession) Broadcast() {
-	// Send player positions
-	var buffer bytes.Buffer
+	snapshot := gs.EncodeSnapshot(gs.Snapshots.Slot(gs.Tick))
+	gs.Snapshots.Store(gs.Tick, snapshot)
+	clear(gs.deltas)
+
+	if gs.Tick%REPLAY_KEYFRAME_INTERVAL == 0 {
+		gs.Recorder.RecordKeyframe(gs.Tick, snapshot)
+	}
 
 	for _, player := range gs.Players {
-		playerData := struct {
-			Id    int32
-			Score int32
-			X     float32
-			Y     float32
-		}{
-			Id:    player.Id,
-			Score: player.Score,
-			X:     player.X,
-			Y:     player.Y,
+		if !player.Disconnected {
+			player.Controller.OnUpdate(float32(SESSION_DELTA_TIME.Seconds()), player.Id, gs)
 		}
+	}
+
+	// Spectators are not a player, so they get the frame for player id 0
+	for spectator := range gs.Spectators {
+		spectator.Controller.OnUpdate(float32(SESSION_DELTA_TIME.Seconds()), 0, gs)
+	}
+}
+
+// Adds a player and starts the game once the session is full
+func (gs *GameSession) HandleRegister(player *Player) {
+	gs.Rollbacks.Invalidate(gs.Tick + 1)
+	gs.AddPlayer(player)
+
+	// Start session if full
+	if len(gs.Players) == gs.Rules.MaxPlayers() {
+		gs.BeginGame()
+	} else {
+		gs.ShouldUpdate = false
+		gs.ResetRound()
+	}
+}
+
+// Removes a player, returns true if the session has no human players left
+func (gs *GameSession) HandleUnregister(player *Player) bool {
+	gs.Rollbacks.Invalidate(gs.Tick + 1)
+
+	// Leaving right after the last point still counts, also when the seat was held
+	if gs.State == GameOver || (gs.State == Paused && gs.PausedState == GameOver) {
+		gs.FinishGame()
+	} else if gs.InGame() {
+		gs.CountGame("abandoned")
+	}
+
+	gs.RemovePlayer(player)
+	gs.InterruptGame()
 
-		if err := binary.Write(&buffer, binary.LittleEndian, playerData); err != nil {
-			panic(err)
+	onlyBots := true
+	for _, player := range gs.Players {
+		_, isBot := player.Controller.(*BotController)
+		if !isBot {
+			onlyBots = false
+			break
 		}
 	}
 
-	// Write ball position and velocity
-	if err := binary.Write(&buffer, binary.LittleEndian, gs.Ball); err != nil {
-		panic(err)
+	if len(gs.Players) == 0 || onlyBots {
+		return true
 	}
 
-	// Write frame events
-	frameEvent := struct {
-		BallCollided   byte
-		BallHitPlayer  byte
-		BallWasSmashed byte
-		NewRound       byte
-	}{
-		BallCollided:   0,
-		BallWasSmashed: 0,
-		NewRound:       0,
+	if len(gs.Players) < gs.Rules.MaxPlayers() {
+		gs.ShouldUpdate = false
+		gs.ResetRound()
 	}
 
-	if gs.Events.BallCollided {
-		frameEvent.BallCollided = 1
+	return false
+}
+
+// Counts the ticks the session waits without a human connected, returns true once it waited too long
+func (gs *GameSession) ExpireIdle() bool {
+	if gs.State != WaitingForPlayers {
+		gs.IdleTicks = 0
+		return false
 	}
 
-	if gs.Events.BallHitPlayer {
-		frameEvent.BallHitPlayer = 1
+	for _, player := range gs.Players {
+		if _, ok := player.Controller.(*PlayerController); ok && !player.Disconnected {
+			gs.IdleTicks = 0
+			return false
+		}
 	}
 
-	if gs.Events.BallWasSmashed {
-		frameEvent.BallWasSmashed = 1
+	gs.IdleTicks++
+	if gs.IdleTicks < WAITING_TIMEOUT_TICKS {
+		return false
 	}
 
-	if gs.Events.NewRound {
-		frameEvent.NewRound = 1
+	gs.Log().Info("No players joined in time", "timeout", WAITING_TIMEOUT)
+	return true
+}
+
+func (gs *GameSession) EndPause() {
+	gs.Rollbacks.Invalidate(gs.Tick)
+
+	// State transitions
+	if gs.State == GameOver {
+		gs.FinishGame()
+		gs.ResetGame()
+		gs.ShouldUpdate = false
+		gs.BeginGame()
+	} else if gs.State == Starting {
+		gs.ShouldUpdate = true
+		gs.BeginRound()
+	} else if gs.State == InBetweenRounds {
+		gs.ResetRound()
+		gs.ShouldUpdate = true
+		gs.BeginRound()
+	} else if gs.State == Running {
+		gs.ShouldUpdate = true
+	}
+}
+
+// Advances the simulation one tick, ending the pause when it runs out
+func (gs *GameSession) Advance() {
+	gs.Tick++
+
+	if gs.PauseTicks > 0 && gs.State != Paused {
+		gs.PauseTicks--
+		if gs.PauseTicks == 0 {
+			gs.EndPause()
+		}
 	}
 
-	if err := binary.Write(&buffer, binary.LittleEndian, frameEvent); err != nil {
-		panic(err)
+	gs.Update(SESSION_DELTA_TIME)
+
+	if gs.Rules.Rollback {
+		gs.SaveState(gs.Rollbacks.Slot(gs.Tick))
 	}
+}
+
+// Takes the round trip times the connections measured, and records them when they change
+func (gs *GameSession) UpdateLatency() {
+	for _, player := range gs.Players {
+		controller, ok := player.Controller.(*PlayerController)
+		if !ok {
+			continue
+		}
+
+		rtt, jitter := controller.Latency()
+		if rtt == player.Rtt && jitter == player.Jitter {
+			continue
+		}
 
-	if err := binary.Write(&buffer, binary.LittleEndian, gs.State); err != nil {
-		panic(err)
+		player.Rtt, player.Jitter = rtt, jitter
+		gs.Recorder.RecordLatency(gs.Tick, player.Id, rtt, jitter)
 	}
+}
+
+// Advances the session one tick and sends the new state to the players
+func (gs *GameSession) Step() {
+	gs.ApplyRollback()
+	gs.Advance()
+	gs.Broadcast()
+}
 
-	gs.StateBuffer = buffer
+// Closes the connections with the reason and saves the replay, the registry lets the server exit after this
+func (gs *GameSession) End(code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	deadline := time.Now().Add(time.Second)
+	gs.CloseMessage = message
 
 	for _, player := range gs.Players {
-		player.Controller.OnUpdate(float32(SESSION_DELTA_TIME.Seconds()), player.Id, gs)
+		if controller, ok := player.Controller.(*PlayerController); ok && !player.Disconnected {
+			controller.Connection.WriteControl(websocket.CloseMessage, message, deadline)
+			controller.HangUp()
+		}
+	}
+
+	// Spectators outlive the players, tell them the session is over
+	for spectator := range gs.Spectators {
+		spectator.Controller.Connection.WriteControl(websocket.CloseMessage, message, deadline)
+		spectator.Controller.HangUp()
+	}
+
+	if err := gs.Recorder.Close(); err != nil {
+		gs.Log().Error("Could not save replay", "error", err)
 	}
+
+	gs.Sessions.Unregister <- gs
 }
 
 func (gs *GameSession) Run() {
 	tick := time.NewTicker(SESSION_DELTA_TIME)
 
 	defer tick.Stop()
+	defer close(gs.Done)
+
+	// A bug in one session ends that session instead of the whole server
 	defer func() {
-		if gs.PauseTimer != nil {
-			gs.PauseTimer.Stop()
+		if err := recover(); err != nil {
+			gs.Log().Error("Session panicked", "error", err, "stack", string(debug.Stack()))
+			gs.CountGame("abandoned")
+			gs.End(websocket.CloseInternalServerErr, "internal error")
 		}
 	}()
 
-	// Game session is paused until both players are ready
-	gs.ShouldUpdate = false
-	gs.State = WaitingForPlayers
+	// Replays can only be played from the start of the session
+	if !gs.Imported {
+		recorder, err := NewReplayRecorder(gs)
+		if err != nil {
+			gs.Log().Error("Could not record replay", "error", err)
+		}
+		gs.Recorder = recorder
+	}
+
+	gs.Log().Info("Running session", "rules", gs.Rules.Name, "imported", gs.Imported)
+	gs.LatestTick.Store(gs.Tick)
 
-	fmt.Println("Running session:", gs.Id)
+	// Closed when the server shuts down, draining is only noticed once
+	draining := gs.Sessions.Draining
+	isDraining := false
+
+	var lastTick time.Time
 
 	for {
 		select {
 		case player := <-gs.RegisterPlayer:
-			fmt.Println("Player registered")
-			gs.AddPlayer(player)
-
-			// Start session if full
-			if len(gs.Players) == MAX_PLAYERS {
-				gs.BeginGame()
-			} else {
-				gs.ShouldUpdate = false
-				gs.ResetRound()
-			}
+			gs.HandleRegister(player)
 		case player := <-gs.UnregisterPlayer:
-			gs.RemovePlayer(player)
-			gs.InterruptGame()
-
-			onlyBots := true
-			for _, player := range gs.Players {
-				_, isBot := player.Controller.(*BotController)
-				if !isBot {
-					onlyBots = false
-					break
-				}
+			if gs.HandleUnregister(player) {
+				gs.End(websocket.CloseNormalClosure, "session ended")
+				return
 			}
-
-			if len(gs.Players) == 0 || onlyBots {
-				gs.Sessions.Unregister <- gs
+		case spectator := <-gs.RegisterSpectator:
+			gs.AddSpectator(spectator)
+		case spectator := <-gs.UnregisterSpectator:
+			gs.RemoveSpectator(spectator)
+		case disconnect := <-gs.DisconnectPlayer:
+			if gs.HandleDisconnect(disconnect) {
+				gs.End(websocket.CloseNormalClosure, "session ended")
 				return
 			}
+		case result := <-gs.Summarize:
+			result <- gs.Summary()
+		case request := <-gs.Export:
+			if err := gs.WriteExport(request.Path); err != nil {
+				request.Result <- err
+				continue
+			}
 
-			if len(gs.Players) < MAX_PLAYERS {
-				gs.ShouldUpdate = false
-				gs.ResetRound()
+			gs.Log().Info("Exported session", "path", request.Path, "redirect", request.Redirect)
+			if gs.InGame() {
+				gs.CountGame("migrated")
 			}
+			gs.End(CLOSE_SESSION_MOVED, request.Redirect)
+			request.Result <- nil
+			return
+		case request := <-gs.ReconnectPlayer:
+			gs.HandleReconnect(request)
 		case inputUpdate := <-gs.RegisterInput:
 			gs.AddPlayerInput(inputUpdate)
-		case <-tick.C:
-			gs.Update(SESSION_DELTA_TIME)
-			gs.Broadcast()
-		case <-gs.PauseTimer.C:
-			// State transitions
-			if gs.State == GameOver {
-				gs.ResetGame()
-				gs.ShouldUpdate = false
-				gs.BeginGame()
-			} else if gs.State == Starting {
-				gs.ShouldUpdate = true
-				gs.BeginRound()
-			} else if gs.State == InBetweenRounds {
-				gs.ResetRound()
-				gs.ShouldUpdate = true
-				gs.BeginRound()
-			} else if gs.State == Running {
-				gs.ShouldUpdate = true
+		case <-draining:
+			draining = nil
+			isDraining = true
+		case <-gs.Sessions.Stopping:
+			// Out of time, the replay keeps the game up to the tick it stopped at
+			gs.Log().Warn("Stopping session that did not finish in time")
+			if gs.InGame() {
+				gs.CountGame("stopped")
+			}
+			gs.End(websocket.CloseServiceRestart, "server restarting")
+			return
+		case scheduled := <-tick.C:
+			start := time.Now()
+			gs.CountTick(scheduled, lastTick)
+			lastTick = scheduled
+
+			gs.UpdateLatency()
+			gs.Step()
+			gs.LatestTick.Store(gs.Tick)
+			gs.TickDurations.Observe(time.Since(start).Seconds())
+			if gs.ExpireSeats() || gs.ExpireIdle() {
+				gs.End(websocket.CloseNormalClosure, "session ended")
+				return
+			}
+
+			// While draining, sessions end before their game starts or once it is over
+			if isDraining && (gs.State == WaitingForPlayers || gs.State == GameOver) {
+				if gs.State == GameOver {
+					gs.FinishGame()
+				}
+
+				gs.Log().Info("Drained session")
+				gs.End(websocket.CloseServiceRestart, "server restarting")
+				return
 			}
 		}
 
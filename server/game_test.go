@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Session with replay players in every slot, driven only by the inputs the test gives it
+func newTestSession(seed int64, rules Rules) *GameSession {
+	gs := NewGameSession(1, seed, rules)
+	gs.Clock = NewTickClock(time.Unix(0, 0))
+
+	for i := 0; i < rules.MaxPlayers(); i++ {
+		gs.HandleRegister(&Player{
+			Id:          int32(i + 1),
+			Controller:  &ReplayController{},
+			Session:     gs,
+			InputStates: make([]InputState, 0),
+			Effects:     make([]Effect, 0),
+			Ready:       make(chan bool, 1),
+		})
+	}
+
+	return gs
+}
+
+// Input log of a test: every player switches between up, down and idle on its own schedule
+func testInput(playerId int32, tick uint32, sequence uint32) (InputUpdate, bool) {
+	period := uint32(5 + 3*playerId)
+	if tick%period != 0 {
+		return InputUpdate{}, false
+	}
+
+	phase := (tick/period + uint32(playerId)) % 3
+	return InputUpdate{
+		PlayerId: playerId,
+		InputState: InputState{
+			UpPressed:   phase == 0,
+			DownPressed: phase == 1,
+			Tick:        tick + 1,
+			Sequence:    sequence,
+			AckTick:     tick,
+		},
+	}, true
+}
+
+func TestSameSeedAndInputsGiveSameState(t *testing.T) {
+	const ticks = 3000
+
+	cases := make(map[string]Rules)
+	for name, rules := range RulePresets {
+		cases[name] = rules
+	}
+
+	// Teammates can both hold a shield, only one of them may use it up
+	doublesPowerUps := RulePresets["doubles"]
+	doublesPowerUps.PowerUps = true
+	doublesPowerUps.PowerUpInterval = 1
+	cases["doubles with power-ups"] = doublesPowerUps
+
+	for name, rules := range cases {
+		t.Run(name, func(t *testing.T) {
+			sessions := []*GameSession{newTestSession(42, rules), newTestSession(42, rules)}
+			sequences := make([]map[int32]uint32, len(sessions))
+			for i := range sequences {
+				sequences[i] = make(map[int32]uint32)
+			}
+
+			var states [2]SimState
+			for tick := 0; tick < ticks; tick++ {
+				for i, gs := range sessions {
+					for _, player := range gs.Slots {
+						if player == nil {
+							continue
+						}
+
+						if input, ok := testInput(player.Id, gs.Tick, sequences[i][player.Id]+1); ok {
+							sequences[i][player.Id]++
+							gs.AddPlayerInput(input)
+						}
+					}
+
+					gs.Step()
+					gs.SaveState(&states[i])
+				}
+
+				if !reflect.DeepEqual(states[0], states[1]) {
+					t.Fatalf("states differ at tick %d:\n%+v\n%+v", sessions[0].Tick, states[0], states[1])
+				}
+
+				first, _ := sessions[0].Snapshots.Get(sessions[0].Tick)
+				second, _ := sessions[1].Snapshots.Get(sessions[1].Tick)
+				if !bytes.Equal(first, second) {
+					t.Fatalf("snapshots differ at tick %d", sessions[0].Tick)
+				}
+			}
+
+			// The run has to get past a goal to cover round resets
+			if sessions[0].Scores == [2]int32{} {
+				t.Fatalf("no goal in %d ticks", ticks)
+			}
+		})
+	}
+}
+
+func TestOtherSeedGivesOtherState(t *testing.T) {
+	rules := RulePresets["classic"]
+	first, second := newTestSession(1, rules), newTestSession(2, rules)
+
+	for tick := 0; tick < 600; tick++ {
+		first.Step()
+		second.Step()
+	}
+
+	if reflect.DeepEqual(first.Balls, second.Balls) {
+		t.Fatalf("balls of different seeds match: %+v", first.Balls)
+	}
+}
+
+func TestDoublesSlots(t *testing.T) {
+	rules := RulePresets["doubles"]
+	gs := newTestSession(1, rules)
+
+	if len(gs.Players) != 4 {
+		t.Fatalf("%d players in doubles, expected 4", len(gs.Players))
+	}
+
+	// Slots alternate sides, the second player of a team takes the front column
+	for slot, player := range gs.Slots {
+		if player == nil || player.Slot != slot {
+			t.Fatalf("slot %d holds %+v", slot, player)
+		}
+		if player.Team != uint8(slot%2) {
+			t.Fatalf("slot %d plays for team %d", slot, player.Team)
+		}
+		if expected := gs.ColumnX(player.Team, slot >= 2); player.X != expected {
+			t.Fatalf("slot %d at x %g, expected %g", slot, player.X, expected)
+		}
+		if (player.X < rules.CourtWidth/2) != (player.Team == 0) {
+			t.Fatalf("slot %d at x %g is on the side of the other team", slot, player.X)
+		}
+	}
+	if gs.Slots[0].X == gs.Slots[2].X || gs.Slots[1].X == gs.Slots[3].X {
+		t.Fatalf("teammates share a column")
+	}
+
+	// A fifth player is turned away
+	extra := &Player{Controller: &ReplayController{}, Session: gs, Ready: make(chan bool, 1)}
+	gs.HandleRegister(extra)
+	if ready := <-extra.Ready; ready || len(gs.Players) != 4 {
+		t.Fatalf("fifth player was let in")
+	}
+
+	// Whoever joins next takes the seat that was given up, on the same team
+	left := gs.Slots[1]
+	gs.HandleUnregister(left)
+	joined := &Player{Id: 5, Controller: &ReplayController{}, Session: gs, Ready: make(chan bool, 1)}
+	gs.HandleRegister(joined)
+	if joined.Slot != 1 || joined.Team != left.Team || joined.X != left.X {
+		t.Fatalf("joined slot %d team %d, the free seat was slot 1 of team %d", joined.Slot, joined.Team, left.Team)
+	}
+}
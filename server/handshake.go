@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a client has to say hello after connecting
+const HELLO_TIMEOUT = 5 * time.Second
+
+// Close codes in the application range, the reason carries the details
+const CLOSE_UNSUPPORTED_VERSION = 4000
+const CLOSE_BAD_HELLO = 4001
+const CLOSE_UNKNOWN_TOKEN = 4002
+
+// Slot and side sent to spectators and replay viewers, who have no paddle
+const SPECTATOR_SLOT = -1
+
+// First message from the client, with the range of frame layouts it can decode.
+// Clients that only know one layout can leave MinVersion out
+type HelloMessage struct {
+	Type       string `json:"type"`
+	Version    int    `json:"version"`
+	MinVersion int    `json:"minVersion,omitempty"`
+}
+
+// Answer to the hello, sent before the first state frame
+type WelcomeMessage struct {
+	Type       string `json:"type"`
+	Version    int    `json:"version"`
+	PlayerId   int32  `json:"playerId"`
+	Slot       int    `json:"slot"`
+	Side       int    `json:"side"`
+	Rules      Rules  `json:"rules"`
+	TickRate   int    `json:"tickRate"`
+	Tick       uint32 `json:"tick"`
+	ServerTime int64  `json:"serverTime"` // Unix milliseconds of the session clock
+
+	// Pass as ?token= with the session id to take the seat back after a dropped connection
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+
+	// Last input sequence received from the player, inputs after a reconnect have to count on from it
+	Sequence uint32 `json:"sequence"`
+}
+
+type HandshakeError struct {
+	Code   int
+	Reason string
+}
+
+func (err *HandshakeError) Error() string {
+	return err.Reason
+}
+
+func NewWelcomeMessage(playerId int32, session *GameSession) WelcomeMessage {
+	slot, side, token := SPECTATOR_SLOT, SPECTATOR_SLOT, ""
+	var sequence uint32 = 0
+	if player, ok := session.Players[playerId]; ok {
+		slot, side, token, sequence = player.Slot, int(player.Team), player.Token, player.ReceivedSequence
+	}
+
+	return WelcomeMessage{
+		Type:       "welcome",
+		Version:    PROTOCOL_VERSION,
+		PlayerId:   playerId,
+		Slot:       slot,
+		Side:       side,
+		Rules:      session.Rules,
+		TickRate:   int(time.Second / SESSION_DELTA_TIME),
+		Tick:       session.Tick,
+		ServerTime: session.Clock.Now().UnixMilli(),
+
+		ReconnectToken: token,
+		Sequence:       sequence,
+	}
+}
+
+func ParseHello(p []byte) (HelloMessage, error) {
+	var hello HelloMessage
+	if err := json.Unmarshal(p, &hello); err != nil || hello.Type != "hello" {
+		return hello, &HandshakeError{CLOSE_BAD_HELLO, "expected hello"}
+	}
+
+	if hello.MinVersion == 0 {
+		hello.MinVersion = hello.Version
+	}
+
+	if PROTOCOL_VERSION < hello.MinVersion || PROTOCOL_VERSION > hello.Version {
+		return hello, &HandshakeError{
+			CLOSE_UNSUPPORTED_VERSION,
+			fmt.Sprintf("unsupported protocol version, server speaks %d", PROTOCOL_VERSION),
+		}
+	}
+
+	return hello, nil
+}
+
+// Waits for the client hello, and closes the connection with the reason if it is not compatible.
+// Afterwards the client has to keep answering pings or sending messages to stay connected
+func ReadHello(conn *websocket.Conn) (HelloMessage, error) {
+	conn.SetReadDeadline(time.Now().Add(HELLO_TIMEOUT))
+	defer KeepAlive(conn)
+
+	mt, p, err := conn.ReadMessage()
+	if err != nil {
+		Metrics.HandshakeErrors.Add(1)
+		if errors.Is(err, websocket.ErrReadLimit) {
+			Metrics.MalformedMessages.Add(1)
+		}
+		return HelloMessage{}, err
+	}
+
+	hello, err := ParseHello(p)
+	if mt != websocket.TextMessage && err == nil {
+		err = &HandshakeError{CLOSE_BAD_HELLO, "expected hello"}
+	}
+
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		Metrics.HandshakeErrors.Add(1)
+		message := websocket.FormatCloseMessage(handshakeErr.Code, handshakeErr.Reason)
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	}
+
+	return hello, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"time"
+)
+
+// Rewinding further would let high latency players return balls everyone else already saw go in
+const MAX_REWIND = 200 * time.Millisecond
+const MAX_REWIND_TICKS = uint32(MAX_REWIND / SESSION_DELTA_TIME)
+
+const LAG_HISTORY = MAX_REWIND_TICKS + 2
+
+// Paddle of a slot during a tick, with the last tick the player had seen when it sent its input
+type PaddleState struct {
+	Id       int32
+	Y        float32
+	Height   float32
+	ViewTick uint32
+}
+
+type TickState struct {
+	Tick    uint32
+	Balls   []Ball
+	Paddles [MAX_PLAYERS]PaddleState
+}
+
+// Ball and paddle states of the last ticks, indexed by tick
+type LagHistory struct {
+	States [LAG_HISTORY]TickState
+}
+
+func (lh *LagHistory) Get(tick uint32) (*TickState, bool) {
+	state := &lh.States[tick%LAG_HISTORY]
+	if tick == 0 || state.Tick != tick {
+		return nil, false
+	}
+
+	return state, true
+}
+
+func (lh *LagHistory) Record(gs *GameSession) {
+	state := &lh.States[gs.Tick%LAG_HISTORY]
+	state.Tick = gs.Tick
+	state.Balls = append(state.Balls[:0], gs.Balls...)
+
+	for slot, player := range gs.Slots {
+		state.Paddles[slot] = PaddleState{}
+		if player != nil {
+			state.Paddles[slot] = PaddleState{
+				Id:       player.Id,
+				Y:        player.Y,
+				Height:   player.Height,
+				ViewTick: player.ViewTick,
+			}
+		}
+	}
+}
+
+// Only players that send the tick they had seen with their inputs can be rewound for,
+// rollback sessions simulate late inputs again instead
+func (gs *GameSession) CanRewind(team uint8) bool {
+	if gs.Rules.Rollback {
+		return false
+	}
+
+	for _, player := range gs.Players {
+		if player.Team == team && player.ViewTick != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findBall(balls []Ball, id uint32) (Ball, bool) {
+	for _, ball := range balls {
+		if ball.Id == id {
+			return ball, true
+		}
+	}
+
+	return Ball{}, false
+}
+
+// Checks if a defender hit a ball that just left the court, as the ball was on its screen when it moved.
+// The paddle of every recent tick is tested against the ball at the tick the player had seen then, and
+// on a hit the ball is bounced back from there and moved forward to the current tick
+func (gs *GameSession) RewindHit(ball *Ball, defendingTeam uint8, frameTime float32) bool {
+	for tick := gs.Tick; tick > 0 && tick+MAX_REWIND_TICKS >= gs.Tick; tick-- {
+		state, ok := gs.LagHistory.Get(tick)
+		if !ok {
+			break
+		}
+
+		for slot, paddle := range state.Paddles {
+			player, ok := gs.Players[paddle.Id]
+			if !ok || player.Team != defendingTeam {
+				continue
+			}
+
+			view := paddle.ViewTick
+			if view == 0 || view >= tick || tick-view > MAX_REWIND_TICKS {
+				continue
+			}
+
+			seen, ok := gs.LagHistory.Get(view)
+			if !ok {
+				continue
+			}
+			before, ok := gs.LagHistory.Get(view - 1)
+			if !ok {
+				continue
+			}
+
+			newBall, ok := findBall(seen.Balls, ball.Id)
+			if !ok {
+				continue
+			}
+			oldBall, ok := findBall(before.Balls, ball.Id)
+			if !ok {
+				continue
+			}
+
+			// Heading for the goal of the defending team, like in MoveBall
+			if (defendingTeam == 0 && newBall.VelocityX > 0) || (defendingTeam == 1 && newBall.VelocityX < 0) {
+				continue
+			}
+
+			rewindPlayer := *player
+			rewindPlayer.X = gs.ColumnX(player.Team, slot >= 2)
+			rewindPlayer.Y = paddle.Y
+			rewindPlayer.Height = paddle.Height
+
+			hit, ok := IsColliding(&oldBall, &newBall, &rewindPlayer)
+			if !ok || newBall.VelocityX*hit.NormalX+newBall.VelocityY*hit.NormalY >= 0 {
+				continue
+			}
+
+			// Only keep the events of the bounce if the ball stays in play
+			events := gs.Events
+			gs.HitBall(&newBall, &oldBall, player, hit)
+			remaining := (1 - hit.Time) * frameTime
+			newBall.X += newBall.VelocityX * remaining
+			newBall.Y += newBall.VelocityY * remaining
+
+			for i := view; i < gs.Tick; i++ {
+				gs.MoveBall(&newBall, frameTime)
+			}
+
+			if newBall.X < 0 || newBall.X > gs.Rules.CourtWidth {
+				gs.Events = events
+				continue
+			}
+
+			gs.Log().Debug("Gave rewound hit", "player", player.Id, "ticks", gs.Tick-view)
+			*ball = newBall
+			return true
+		}
+	}
+
+	return false
+}
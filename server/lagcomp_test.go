@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+)
+
+// Records a ball flying past the paddle of the left team into its goal, 20 pixels a tick. The paddle
+// only moves into the way once the ball is out, the player saw the ball lag ticks late all along
+func rewindTestSession(rules Rules, lag uint32) (*GameSession, float32) {
+	const crossed = 20 // Tick the ball crossed the paddle column
+
+	gs := newTestSession(1, rules)
+	defender := gs.Slots[0]
+	frameTime := float32(SESSION_DELTA_TIME.Seconds())
+	front := defender.X + defender.Width + BALL_RADIUS
+
+	ball := gs.Balls[0]
+	ball.Y = rules.CourtHeight / 2
+	ball.VelocityX = -20 / frameTime
+	ball.VelocityY = 0
+
+	for tick := uint32(1); tick <= crossed+lag; tick++ {
+		gs.Tick = tick
+		ball.X = front + 5 - 20*float32(int(tick)-(crossed-1))
+		gs.Balls = []Ball{ball}
+
+		defender.Y = 0
+		if tick == crossed+lag {
+			defender.Y = ball.Y - defender.Height/2
+		}
+		defender.ViewTick = 0
+		if tick > lag {
+			defender.ViewTick = tick - lag
+		}
+
+		gs.LagHistory.Record(gs)
+	}
+
+	return gs, frameTime
+}
+
+func TestRewindHit(t *testing.T) {
+	rules := RulePresets["classic"]
+
+	for lag := uint32(2); lag <= MAX_REWIND_TICKS; lag++ {
+		gs, frameTime := rewindTestSession(rules, lag)
+		ball := gs.Balls[0]
+		if ball.X >= 0 {
+			t.Fatalf("lag %d: ball at x %g has not left the court", lag, ball.X)
+		}
+
+		if !gs.RewindHit(&ball, 0, frameTime) {
+			t.Fatalf("lag %d: no rewound hit within %d ticks", lag, MAX_REWIND_TICKS)
+		}
+		if ball.VelocityX <= 0 || ball.X < 0 || ball.X > rules.CourtWidth {
+			t.Fatalf("lag %d: rewound ball %+v is not back in play", lag, ball)
+		}
+	}
+
+	gs, frameTime := rewindTestSession(rules, MAX_REWIND_TICKS+1)
+	ball := gs.Balls[0]
+	if gs.RewindHit(&ball, 0, frameTime) {
+		t.Fatalf("rewound hit %d ticks back, beyond %s", MAX_REWIND_TICKS+1, MAX_REWIND)
+	}
+}
+
+func TestRollbackSessionsDoNotRewind(t *testing.T) {
+	rules := RulePresets["classic"]
+	rules.Rollback = true
+
+	gs, _ := rewindTestSession(rules, 4)
+	if gs.CanRewind(0) {
+		t.Fatalf("rollback session rewinds for a player that sent its view tick")
+	}
+}
+
+// Steps until the ball that just left the left goal is scored, returns the ticks that took
+func ticksUntilGoal(t *testing.T, rules Rules, viewTick bool) uint32 {
+	gs := newTestSession(1, rules)
+	startTestGame(t, gs)
+
+	defender := gs.Slots[0]
+	defender.Y = 0
+	gs.Balls = gs.Balls[:1]
+	gs.Balls[0].X = 1
+	gs.Balls[0].Y = rules.CourtHeight - 2*BALL_RADIUS
+	gs.Balls[0].VelocityX = -rules.BallSpeed
+	gs.Balls[0].VelocityY = 0
+
+	start := gs.Tick
+	for gs.Scores[1] == 0 {
+		if viewTick {
+			defender.ViewTick = gs.Tick
+		}
+		gs.Step()
+
+		if gs.Tick-start > 2*MAX_REWIND_TICKS {
+			t.Fatalf("no goal %d ticks after the ball left", gs.Tick-start)
+		}
+	}
+
+	return gs.Tick - start
+}
+
+func TestGoalsWaitForRewindWindow(t *testing.T) {
+	rules := RulePresets["classic"]
+
+	// A defender that sends the tick it had seen may still return the ball, the goal waits for it
+	if ticks := ticksUntilGoal(t, rules, true); ticks < MAX_REWIND_TICKS || ticks > MAX_REWIND_TICKS+2 {
+		t.Fatalf("goal took %d ticks with a human defender, expected %d", ticks, MAX_REWIND_TICKS)
+	}
+
+	// Without a view tick, or with rollback, there is nothing to wait for
+	if ticks := ticksUntilGoal(t, rules, false); ticks > 2 {
+		t.Fatalf("goal took %d ticks without a view tick", ticks)
+	}
+
+	rules.Rollback = true
+	if ticks := ticksUntilGoal(t, rules, true); ticks > 2 {
+		t.Fatalf("goal took %d ticks in a rollback session", ticks)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level of the whole server, set from LOG_LEVEL
+var LogLevel = new(slog.LevelVar)
+
+// Lets every level through, the loggers built on it filter with a LevelHandler
+var LogHandler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+// Filters records on a level that can change while the server runs
+type LevelHandler struct {
+	Handler slog.Handler
+	Level   slog.Leveler
+}
+
+func (h *LevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.Level.Level()
+}
+
+func (h *LevelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *LevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LevelHandler{Handler: h.Handler.WithAttrs(attrs), Level: h.Level}
+}
+
+func (h *LevelHandler) WithGroup(name string) slog.Handler {
+	return &LevelHandler{Handler: h.Handler.WithGroup(name), Level: h.Level}
+}
+
+// Level of a session, debug while it is switched on for the session and the server level otherwise
+type SessionLevel struct {
+	Debug atomic.Bool
+}
+
+func (sl *SessionLevel) Level() slog.Level {
+	if sl.Debug.Load() {
+		return slog.LevelDebug
+	}
+
+	return LogLevel.Level()
+}
+
+// Sets up the default logger, format is text or json and level one of debug, info, warn or error
+func SetupLogging(format string, level string) error {
+	if level != "" {
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(level)); err != nil {
+			return err
+		}
+		LogLevel.Set(parsed)
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch strings.ToLower(format) {
+	case "", "text":
+		LogHandler = slog.NewTextHandler(os.Stdout, options)
+	case "json":
+		LogHandler = slog.NewJSONHandler(os.Stdout, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(&LevelHandler{Handler: LogHandler, Level: LogLevel}))
+	return nil
+}
+
+func NewSessionLogger(id int, level *SessionLevel) *slog.Logger {
+	return slog.New(&LevelHandler{Handler: LogHandler, Level: level}).With("session", id)
+}
+
+// Logger with the tick and state of the session, only call from the session goroutine
+func (gs *GameSession) Log() *slog.Logger {
+	return gs.Logger.With("tick", gs.Tick, "state", gs.State.String())
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/acme/autocert"
@@ -21,22 +29,35 @@ func handleSessions(sessions *Sessions, w http.ResponseWriter, r *http.Request)
 	// Make CORS happy
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
-	fmt.Fprintf(w, "[")
-	var index int = 0
-	for id := range sessions.Sessions {
-		fmt.Fprintf(w, "{")
-		fmt.Fprintf(w, "\"id\": %d", id)
-		fmt.Fprintf(w, ",")
-		fmt.Fprintf(w, "\"numPlayers\": %d", len(sessions.Sessions[id].Players))
-		fmt.Fprintf(w, "}")
-		if index < len(sessions.Sessions)-1 {
-			fmt.Fprintf(w, ",")
+	// Create a session with the rules from the query or JSON body
+	if r.Method == http.MethodPost {
+		rules, err := ParseRules(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		index++
+
+		session := sessions.RequestCreate(rules)
+		if session == nil {
+			http.Error(w, "server restarting", http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Id    int   `json:"id"`
+			Rules Rules `json:"rules"`
+		}{session.Id, session.Rules})
+		return
 	}
-	fmt.Fprintf(w, "]")
+
+	json.NewEncoder(w).Encode(sessions.Summaries())
 }
 
 func handlePlay(sessions *Sessions, w http.ResponseWriter, r *http.Request) {
@@ -44,105 +65,517 @@ func handlePlay(sessions *Sessions, w http.ResponseWriter, r *http.Request) {
 	// Find or register session
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
-		panic(err)
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
 	}
 
-	session, ok := sessions.Sessions[id]
-	if !ok {
-		session = NewGameSession(id)
-		sessions.Register <- session
+	logger := slog.With("session", id, "remote", r.RemoteAddr)
+
+	spectate, err := strconv.ParseBool(r.URL.Query().Get("spectate"))
+	if err != nil {
+		spectate = false
+	}
+
+	// The session logger carries the debug level the session was switched to
+	session := sessions.Find(id, nil).Session
+	if session != nil {
+		logger = session.Logger.With("remote", r.RemoteAddr)
+	}
+
+	if spectate {
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		handleSpectate(session, w, r)
+		return
+	}
+
+	// Guests play without a profile and are not rated
+	profileId := r.URL.Query().Get("profile")
+	if _, found := sessions.Profiles.Get(profileId); profileId != "" && !found {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+
+	// A dropped player takes its seat back with the token from the welcome
+	token := r.URL.Query().Get("token")
+	if token != "" && session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// Rules only matter if the session has to be started
+	var rules *Rules
+	if session == nil {
+		parsed, err := ParseRules(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules = &parsed
 	}
 
 	// Create and register player
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		panic(err)
+		logger.Warn("Upgrade failed", "error", err)
+		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
 
-	player := &Player{
-		Controller:  NewPlayerController(conn),
-		Score:       0,
-		X:           0,
-		Y:           0,
-		Session:     session,
-		InputStates: make([]InputState, 0),
-		Ready:       make(chan bool),
+	if _, err := ReadHello(conn); err != nil {
+		logger.Warn("Handshake failed", "error", err)
+		return
 	}
 
-	session.RegisterPlayer <- player
+	controller := NewPlayerController(conn)
+	defer controller.Stop()
+	controller.logger.Store(logger)
+
+	var player *Player
+	playerOk := false
+
+	if token != "" {
+		request := ReconnectRequest{Token: token, Controller: controller, Result: make(chan *Player, 1)}
+		select {
+		case session.ReconnectPlayer <- request:
+		case <-session.Done:
+			conn.WriteControl(websocket.CloseMessage, session.CloseMessage, time.Now().Add(time.Second))
+			return
+		}
+
+		player = <-request.Result
+		if player == nil {
+			message := websocket.FormatCloseMessage(CLOSE_UNKNOWN_TOKEN, "unknown reconnect token")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			return
+		}
+		playerOk = true
+	} else {
+		// Only start new sessions once the client is known to speak the protocol,
+		// whoever gets there first starts it
+		found := sessions.Find(id, rules)
+		session = found.Session
+		if session == nil {
+			message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session ended")
+			select {
+			case <-sessions.Draining:
+				message = websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+			default:
+			}
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			return
+		}
+		logger = session.Logger.With("remote", r.RemoteAddr)
+		controller.logger.Store(logger)
+
+		player = NewPlayer(controller, session)
+		player.ProfileId = profileId
+
+		if !registerPlayer(conn, sessions, session, player) {
+			return
+		}
 
-	{
 		ai, err := strconv.ParseBool(r.URL.Query().Get("ai"))
 		if err != nil {
 			ai = false
 		}
 
-		fmt.Println("ai", ai)
+		logger.Debug("Joining session", "ai", ai, "created", found.Created)
+
+		if found.Created && ai && !registerPlayer(conn, sessions, session, NewPlayer(NewBotController(), session)) {
+			return
+		}
+
+		select {
+		case playerOk = <-player.Ready:
+		case <-session.Done:
+			conn.WriteControl(websocket.CloseMessage, session.CloseMessage, time.Now().Add(time.Second))
+		}
+	}
+
+	var readErr error
+
+	for playerOk {
+		mt, p, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// Reading stops at an oversized message, the player is kicked rather than dropped
+			controller.Reject(err)
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		KeepAlive(conn)
+
+		if mt == websocket.CloseMessage {
+			break
+		}
+
+		if err := CheckMessage(mt, p, true); err != nil {
+			if controller.Reject(err) {
+				controller.Close(websocket.ClosePolicyViolation, "too many malformed messages")
+				break
+			}
+			continue
+		}
 
-		if !ok && ai {
+		if controller.ReadAck(p) {
+			continue
+		}
 
-			ai := &Player{
-				Controller:  NewBotController(),
-				Score:       0,
-				X:           0,
-				Y:           0,
-				Session:     session,
-				InputStates: make([]InputState, 0),
-				Ready:       make(chan bool),
+		inputUpdate, err := ReadInput(p, player.Id)
+		if err != nil {
+			if controller.Reject(err) {
+				controller.Close(websocket.ClosePolicyViolation, "too many malformed messages")
+				break
 			}
+			continue
+		}
 
-			session.RegisterPlayer <- ai
+		if session.Rules.Rollback && controller.RejectLate(inputUpdate.InputState, session.LatestTick.Load()) {
+			controller.Close(websocket.ClosePolicyViolation, "too many late inputs")
+			break
+		}
+
+		Metrics.InputsReceived.Add(1)
+		select {
+		case session.RegisterInput <- inputUpdate:
+		case <-session.Done:
+			return
 		}
 	}
 
-	playerOk := false
+	if !playerOk {
+		return
+	}
 
-loop:
-	for {
+	// Leaving on purpose or being kicked gives the seat up, anything else holds it for a reconnect
+	if readErr == nil || websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		controller.Log().Info("Player left")
 		select {
-		case ok := <-player.Ready:
-			if !ok {
-				break loop
-			}
-			playerOk = true
+		case session.UnregisterPlayer <- player:
+		case <-session.Done:
+		}
+		return
+	}
+
+	// Closed on this side, by the session when it ends or moves, by a reconnect taking the seat,
+	// or by the writer giving up on the client
+	if controller.HungUp() {
+		select {
+		case <-session.Done:
+			return
 		default:
-			if !playerOk {
-				continue loop
-			}
+		}
+		controller.Log().Debug("Player connection closed", "error", readErr)
+	} else {
+		Metrics.ReadErrors.Add(1)
+		controller.Log().Info("Player dropped", "error", readErr)
+	}
+	select {
+	case session.DisconnectPlayer <- Disconnect{Player: player, Controller: controller}:
+	case <-session.Done:
+	}
+}
 
-			mt, p, err := conn.ReadMessage()
-			if err != nil {
-				break loop
+// Hands the player to the session, unless the session ended first or the server is stopping,
+// then the client is told why and false is returned
+func registerPlayer(conn *websocket.Conn, sessions *Sessions, session *GameSession, player *Player) bool {
+	message := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	select {
+	case session.RegisterPlayer <- player:
+		return true
+	case <-session.Done:
+		message = session.CloseMessage
+	case <-sessions.Stopping:
+	}
+
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return false
+}
+
+func handleSpectate(session *GameSession, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		session.Logger.Warn("Spectator upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
+
+	if _, err := ReadHello(conn); err != nil {
+		session.Logger.Warn("Spectator handshake failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+
+	spectator := &Spectator{
+		Controller: NewPlayerController(conn),
+		Session:    session,
+	}
+	defer spectator.Controller.Stop()
+
+	select {
+	case session.RegisterSpectator <- spectator:
+	case <-session.Done:
+		return
+	}
+
+	// Spectators never send input, only acknowledgements and reads to notice when they leave
+	for {
+		mt, p, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			spectator.Controller.Reject(err)
+			break
+		}
+		if err != nil || mt == websocket.CloseMessage {
+			break
+		}
+		KeepAlive(conn)
+
+		if err := CheckMessage(mt, p, false); err != nil {
+			if spectator.Controller.Reject(err) {
+				spectator.Controller.Close(websocket.ClosePolicyViolation, "too many malformed messages")
+				break
 			}
+			continue
+		}
+
+		spectator.Controller.ReadAck(p)
+	}
 
-			if mt == websocket.CloseMessage {
-				break loop
+	select {
+	case session.UnregisterSpectator <- spectator:
+	case <-session.Done:
+	}
+}
+
+func handleQueue(sessions *Sessions, w http.ResponseWriter, r *http.Request) {
+	allowBot, err := strconv.ParseBool(r.URL.Query().Get("ai"))
+	if err != nil {
+		allowBot = false
+	}
+
+	profileId := r.URL.Query().Get("profile")
+	var rating float64 = DEFAULT_RATING
+	if profileId != "" {
+		profile, ok := sessions.Profiles.Get(profileId)
+		if !ok {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		rating = profile.Rating
+	}
+
+	rules, err := ParseRules(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The upgrader already answered the request
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Queue upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
+
+	ticket := NewQueueTicket(allowBot, profileId, rating, rules)
+	select {
+	case sessions.Enqueue <- ticket:
+	case <-sessions.Stopped:
+		return
+	}
+
+	// Notice if the player gives up waiting, or its connection went away without closing
+	KeepAlive(conn)
+	conn.SetPongHandler(func(string) error {
+		KeepAlive(conn)
+		return nil
+	})
+
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if errors.Is(err, websocket.ErrReadLimit) {
+					Metrics.MalformedMessages.Add(1)
+				}
+				return
 			}
+			KeepAlive(conn)
+		}
+	}()
+
+	ping := time.NewTicker(PING_INTERVAL)
+	defer ping.Stop()
 
-			if (mt != websocket.BinaryMessage) && (len(p) != (2 + 4 + 4)) {
-				continue loop
+	for {
+		select {
+		case <-ping.C:
+			conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_TIMEOUT))
+			continue
+		case assignment := <-ticket.Assigned:
+			if err := conn.WriteJSON(assignment); err != nil {
+				slog.Warn("Could not send queue assignment", "session", assignment.SessionId, "error", err)
+				return
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "matched"))
+		case <-left:
+			select {
+			case sessions.Dequeue <- ticket:
+			case <-sessions.Stopped:
 			}
+		case <-sessions.Draining:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+		}
+		return
+	}
+}
 
-			inputUpdate := ReadInput(p, player.Id)
-			session.RegisterInput <- inputUpdate
+// POST creates a new profile, the returned id is what the client passes as ?profile=
+func handleCreatePlayer(profiles *Profiles, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profile, err := profiles.Create(r.URL.Query().Get("name"))
+	if err != nil {
+		slog.Error("Could not create profile", "error", err)
+		http.Error(w, "could not create profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func handlePlayer(profiles *Profiles, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	profile, ok := profiles.Get(strings.TrimPrefix(r.URL.Path, "/players/"))
+	if !ok {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func handleReplay(sessions *Sessions, w http.ResponseWriter, r *http.Request) {
+	// The latest replay of a session, or one replay by the name listed on /sessions
+	name := r.URL.Query().Get("name")
+	if r.URL.Query().Has("id") {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+
+		latest, ok := LatestReplay(id)
+		if !ok {
+			http.Error(w, "replay not found", http.StatusNotFound)
+			return
 		}
+		name = latest
+	}
+
+	path, ok := ReplayPath(name)
+	if !ok {
+		http.Error(w, "invalid replay name", http.StatusBadRequest)
+		return
 	}
 
-	session.UnregisterPlayer <- player
+	logger := slog.With("replay", name, "remote", r.RemoteAddr)
+
+	replay, err := LoadReplay(path)
+	if err != nil {
+		logger.Warn("Could not load replay", "error", err)
+		http.Error(w, "replay not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("Could not upgrade connection", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
+
+	if _, err := ReadHello(conn); err != nil {
+		logger.Warn("Handshake failed", "error", err)
+		return
+	}
+
+	// Viewers are sent away as soon as the server drains, like players waiting in the queue
+	if err := PlayReplay(conn, replay, sessions.Draining); err != nil {
+		if errors.Is(err, ErrReplayStopped) {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+			return
+		}
+		logger.Info("Replay stopped", "error", err)
+		return
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay finished"))
 }
 
 func main() {
 
+	// LOG_FORMAT is text or json, LOG_LEVEL one of debug, info, warn or error
+	if err := SetupLogging(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL")); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging: %s\n", err)
+		return
+	}
+
 	production, err := strconv.ParseBool(os.Getenv("PRODUCTION"))
 
 	if err != nil {
 		production = false
 	}
 
-	sessions := NewSessions()
+	botTimeout, err := time.ParseDuration(os.Getenv("QUEUE_BOT_TIMEOUT"))
+	if err != nil {
+		botTimeout = DEFAULT_QUEUE_BOT_TIMEOUT
+	}
+
+	profiles, err := LoadProfiles(PROFILES_PATH)
+	if err != nil {
+		slog.Error("Could not load profiles", "error", err)
+		return
+	}
+
+	sessions := NewSessions(botTimeout, profiles)
 	go sessions.Run()
 
+	// Sessions can be moved between servers through the admin socket, it is off unless a path is set
+	if adminPath := os.Getenv("ADMIN_SOCKET"); adminPath != "" {
+		admin, err := ListenAdmin(adminPath, sessions)
+		if err != nil {
+			slog.Error("Could not listen on admin socket", "error", err)
+			return
+		}
+		defer admin.Close()
+	}
+
 	http.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
 		handleSessions(sessions, w, r)
 	})
@@ -151,9 +584,49 @@ func main() {
 		handlePlay(sessions, w, r)
 	})
 
+	http.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		handleQueue(sessions, w, r)
+	})
+
+	http.HandleFunc("/players", func(w http.ResponseWriter, r *http.Request) {
+		handleCreatePlayer(profiles, w, r)
+	})
+
+	http.HandleFunc("/players/", func(w http.ResponseWriter, r *http.Request) {
+		handlePlayer(profiles, w, r)
+	})
+
+	http.HandleFunc("/replay", func(w http.ResponseWriter, r *http.Request) {
+		handleReplay(sessions, w, r)
+	})
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(sessions, w, r)
+	})
+
+	// Running games get to finish before the server exits on SIGTERM or ctrl-c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	drainTimeout, err := time.ParseDuration(os.Getenv("DRAIN_TIMEOUT"))
+	if err != nil {
+		drainTimeout = DEFAULT_DRAIN_TIMEOUT
+	}
+
+	servers := make([]*http.Server, 0)
+	serve := func(server *http.Server, listen func() error) {
+		servers = append(servers, server)
+		go func() {
+			if err := listen(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Server error", "addr", server.Addr, "error", err)
+				stop()
+			}
+		}()
+	}
+
 	if production {
 
-		fmt.Println("Running in Production mode")
+		slog.Info("Running in production mode")
 
 		certManager := &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
@@ -169,26 +642,36 @@ func main() {
 			},
 		}
 
-		go func() {
-			err := http.ListenAndServe(":80", certManager.HTTPHandler(nil))
-			if err != nil {
-				fmt.Printf("HTTP server error: %s\n", err)
-			}
-		}()
-
-		fmt.Println("Server listening on :80 for HTTP challenges and :443 for HTTPS")
-		err := server.ListenAndServeTLS("", "")
-		if err != nil {
-			fmt.Printf("Server error: %s\n", err)
+		challengeServer := &http.Server{
+			Addr:    ":80",
+			Handler: certManager.HTTPHandler(nil),
 		}
 
+		slog.Info("Server listening on :80 for HTTP challenges and :443 for HTTPS")
+		serve(challengeServer, challengeServer.ListenAndServe)
+		serve(server, func() error { return server.ListenAndServeTLS("", "") })
+
 	} else {
 
-		fmt.Println("Server listening on :5000")
-		err := http.ListenAndServe(":5000", nil)
-		if err != nil {
-			fmt.Printf("Server error: %s\n", err)
-		}
+		slog.Info("Server listening on :5000")
+		server := &http.Server{Addr: ":5000"}
+		serve(server, server.ListenAndServe)
+
+	}
 
+	<-ctx.Done()
+	stop()
+
+	// Reconnects are still served while draining, so the listeners close last
+	slog.Info("Shutting down")
+	sessions.Drain <- drainTimeout
+	<-sessions.Stopped
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Shutdown error", "addr", server.Addr, "error", err)
+		}
 	}
 }
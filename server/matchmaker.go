@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const DEFAULT_QUEUE_BOT_TIMEOUT = 15 * time.Second
+const MATCHMAKER_INTERVAL = 1 * time.Second
+
+// Rating difference accepted right away, widened for every second spent waiting
+const MATCH_RATING_TOLERANCE = 100
+const MATCH_RATING_TOLERANCE_GROWTH = 25
+
+// Session a queued player should join with /play?id=
+type QueueAssignment struct {
+	SessionId int  `json:"id"`
+	Bot       bool `json:"bot"`
+}
+
+type QueueTicket struct {
+	JoinedAt  time.Time
+	AllowBot  bool
+	ProfileId string
+	Rating    float64
+	Rules     Rules
+	Assigned  chan QueueAssignment
+}
+
+type Matchmaker struct {
+	Waiting []*QueueTicket
+	// How long a player waits before being matched with a bot, zero disables bots
+	BotTimeout time.Duration
+}
+
+func NewQueueTicket(allowBot bool, profileId string, rating float64, rules Rules) *QueueTicket {
+	return &QueueTicket{
+		JoinedAt:  time.Now(),
+		AllowBot:  allowBot,
+		ProfileId: profileId,
+		Rating:    rating,
+		Rules:     rules,
+		Assigned:  make(chan QueueAssignment, 1),
+	}
+}
+
+func (qt *QueueTicket) Tolerance() float64 {
+	return MATCH_RATING_TOLERANCE + MATCH_RATING_TOLERANCE_GROWTH*time.Since(qt.JoinedAt).Seconds()
+}
+
+func NewMatchmaker(botTimeout time.Duration) *Matchmaker {
+	return &Matchmaker{
+		Waiting:    make([]*QueueTicket, 0),
+		BotTimeout: botTimeout,
+	}
+}
+
+func (mm *Matchmaker) Add(ticket *QueueTicket) {
+	mm.Waiting = append(mm.Waiting, ticket)
+}
+
+func (mm *Matchmaker) Remove(ticket *QueueTicket) {
+	for i, waiting := range mm.Waiting {
+		if waiting == ticket {
+			mm.Waiting = append(mm.Waiting[:i], mm.Waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Groups the longest waiting players with the closest rated opponents within their tolerance, on the same rules,
+// and fills up the sessions of the ones that waited too long with bots
+func (mm *Matchmaker) Match(sessions *Sessions) {
+	matched := make(map[*QueueTicket]bool)
+	for i, first := range mm.Waiting {
+		if matched[first] {
+			continue
+		}
+
+		candidates := make([]*QueueTicket, 0)
+		for _, other := range mm.Waiting[i+1:] {
+			if matched[other] || other.Rules != first.Rules {
+				continue
+			}
+
+			difference := math.Abs(first.Rating - other.Rating)
+			if difference > math.Max(first.Tolerance(), other.Tolerance()) {
+				continue
+			}
+
+			candidates = append(candidates, other)
+		}
+
+		needed := first.Rules.MaxPlayers() - 1
+		if len(candidates) < needed {
+			continue
+		}
+
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return math.Abs(first.Rating-candidates[a].Rating) < math.Abs(first.Rating-candidates[b].Rating)
+		})
+
+		group := append([]*QueueTicket{first}, candidates[:needed]...)
+		session := sessions.Create(first.Rules)
+		for _, ticket := range group {
+			matched[ticket] = true
+			ticket.Assigned <- QueueAssignment{SessionId: session.Id}
+		}
+		session.Logger.Info("Matched players", "players", len(group))
+	}
+
+	if len(matched) > 0 {
+		waiting := make([]*QueueTicket, 0, len(mm.Waiting))
+		for _, ticket := range mm.Waiting {
+			if !matched[ticket] {
+				waiting = append(waiting, ticket)
+			}
+		}
+		mm.Waiting = waiting
+	}
+
+	if mm.BotTimeout <= 0 {
+		return
+	}
+
+	waiting := make([]*QueueTicket, 0, len(mm.Waiting))
+	for _, ticket := range mm.Waiting {
+		if !ticket.AllowBot || time.Since(ticket.JoinedAt) < mm.BotTimeout {
+			waiting = append(waiting, ticket)
+			continue
+		}
+
+		session := sessions.Create(ticket.Rules)
+		for i := 1; i < ticket.Rules.MaxPlayers(); i++ {
+			session.RegisterPlayer <- NewPlayer(NewBotController(), session)
+		}
+		ticket.Assigned <- QueueAssignment{SessionId: session.Id, Bot: true}
+		session.Logger.Info("Matched player with bots", "profile", ticket.ProfileId)
+	}
+	mm.Waiting = waiting
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Ends of games, anything but finished means the game was cut short
+var GAME_OUTCOMES = []string{"finished", "abandoned", "stopped", "migrated"}
+
+var TICK_DURATION_BUCKETS = []float64{0.0005, 0.001, 0.002, 0.004, 0.008, 0.016, 0.032}
+var FRAME_BYTES_BUCKETS = []float64{32, 64, 96, 128, 192, 256, 512, 1024}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Cumulative buckets like Prometheus keeps them, safe to observe from any goroutine
+type Histogram struct {
+	Buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64 // Bits of a float64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// Counters of the whole server, sessions that ended still count
+type ServerMetrics struct {
+	LateTicks         Counter
+	MissedTicks       Counter
+	InputsReceived    Counter
+	ReadErrors        Counter
+	WriteErrors       Counter
+	HandshakeErrors   Counter
+	MalformedMessages Counter
+	FrameBytes        *Histogram
+	GamesCompleted    map[string]*Counter // Keyed by outcome, never written after init
+}
+
+var Metrics = NewServerMetrics()
+
+func NewServerMetrics() *ServerMetrics {
+	metrics := &ServerMetrics{
+		FrameBytes:     NewHistogram(FRAME_BYTES_BUCKETS),
+		GamesCompleted: make(map[string]*Counter),
+	}
+
+	for _, outcome := range GAME_OUTCOMES {
+		metrics.GamesCompleted[outcome] = &Counter{}
+	}
+
+	return metrics
+}
+
+// Counts the end of a game, sessions played back from replays are not counted
+func (gs *GameSession) CountGame(outcome string) {
+	if gs.Sessions != nil {
+		Metrics.GamesCompleted[outcome].Add(1)
+	}
+}
+
+// Notices ticks that fired late or not at all because the session fell behind
+func (gs *GameSession) CountTick(scheduled time.Time, last time.Time) {
+	if time.Since(scheduled) > SESSION_DELTA_TIME/2 {
+		Metrics.LateTicks.Add(1)
+	}
+
+	if !last.IsZero() {
+		if missed := (scheduled.Sub(last)+SESSION_DELTA_TIME/2)/SESSION_DELTA_TIME - 1; missed > 0 {
+			Metrics.MissedTicks.Add(uint64(missed))
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writes the series of the histogram, labels are empty or end with a comma
+func writeHistogram(w io.Writer, name string, labels string, h *Histogram) {
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(bound), h.counts[i].Load())
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, count)
+
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(math.Float64frombits(h.sum.Load())))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+// Text exposition format, so the server can be scraped without a client library
+func handleMetrics(sessions *Sessions, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	summaries := sessions.Summaries()
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Id < summaries[j].Id
+	})
+
+	var players, bots, disconnected, spectators int
+	for _, summary := range summaries {
+		spectators += summary.NumSpectators
+		for _, player := range summary.Players {
+			if player.Bot {
+				bots++
+			} else if player.Disconnected {
+				disconnected++
+			} else {
+				players++
+			}
+		}
+	}
+
+	writeHeader(w, "pong_sessions_active", "gauge", "Sessions currently running.")
+	fmt.Fprintf(w, "pong_sessions_active %d\n", len(summaries))
+
+	writeHeader(w, "pong_players_connected", "gauge", "Players in running sessions, held seats count as disconnected.")
+	fmt.Fprintf(w, "pong_players_connected{kind=\"player\"} %d\n", players)
+	fmt.Fprintf(w, "pong_players_connected{kind=\"bot\"} %d\n", bots)
+	fmt.Fprintf(w, "pong_players_connected{kind=\"disconnected\"} %d\n", disconnected)
+
+	writeHeader(w, "pong_spectators_connected", "gauge", "Spectators in running sessions.")
+	fmt.Fprintf(w, "pong_spectators_connected %d\n", spectators)
+
+	writeHeader(w, "pong_tick_duration_seconds", "histogram", "Time a session takes to simulate and send a tick.")
+	for _, summary := range summaries {
+		writeHistogram(w, "pong_tick_duration_seconds", fmt.Sprintf("session=\"%d\",", summary.Id), summary.TickDurations)
+	}
+
+	writeHeader(w, "pong_ticks_late_total", "counter", "Ticks a session ran more than half a tick after they were due.")
+	fmt.Fprintf(w, "pong_ticks_late_total %d\n", Metrics.LateTicks.Value())
+
+	writeHeader(w, "pong_ticks_missed_total", "counter", "Ticks dropped because a session was still busy with the one before.")
+	fmt.Fprintf(w, "pong_ticks_missed_total %d\n", Metrics.MissedTicks.Value())
+
+	writeHeader(w, "pong_frame_bytes", "histogram", "Size of the state frames written to clients.")
+	writeHistogram(w, "pong_frame_bytes", "", Metrics.FrameBytes)
+
+	writeHeader(w, "pong_inputs_received_total", "counter", "Inputs received from players.")
+	fmt.Fprintf(w, "pong_inputs_received_total %d\n", Metrics.InputsReceived.Value())
+
+	writeHeader(w, "pong_malformed_messages_total", "counter", "Client messages that were not an input or an ack.")
+	fmt.Fprintf(w, "pong_malformed_messages_total %d\n", Metrics.MalformedMessages.Value())
+
+	writeHeader(w, "pong_websocket_errors_total", "counter", "Failed websocket handshakes, reads and writes.")
+	fmt.Fprintf(w, "pong_websocket_errors_total{op=\"handshake\"} %d\n", Metrics.HandshakeErrors.Value())
+	fmt.Fprintf(w, "pong_websocket_errors_total{op=\"read\"} %d\n", Metrics.ReadErrors.Value())
+	fmt.Fprintf(w, "pong_websocket_errors_total{op=\"write\"} %d\n", Metrics.WriteErrors.Value())
+
+	writeHeader(w, "pong_games_completed_total", "counter", "Games that ended, by how they ended.")
+	for _, outcome := range GAME_OUTCOMES {
+		fmt.Fprintf(w, "pong_games_completed_total{outcome=\"%s\"} %d\n", outcome, Metrics.GamesCompleted[outcome].Value())
+	}
+}
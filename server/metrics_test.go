@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var sampleLine = regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? (\S+)$`)
+
+// Scrapes the server and checks the text format, returns the samples by name and labels
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	response, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", contentType)
+	}
+
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	helped := make(map[string]bool)
+
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if fields := strings.Fields(line); len(fields) >= 4 && fields[0] == "#" {
+			switch fields[1] {
+			case "HELP":
+				helped[fields[2]] = true
+			case "TYPE":
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		match := sampleLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("invalid sample line %q", line)
+		}
+
+		family := match[1]
+		if types[family] == "" {
+			family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+		}
+		if types[family] == "" || !helped[family] {
+			t.Fatalf("sample %q before the HELP and TYPE of %s", line, family)
+		}
+
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Fatalf("invalid value in %q", line)
+		}
+		samples[match[1]+match[2]] = value
+	}
+
+	return samples
+}
+
+// Buckets have to count up to the +Inf bucket, which matches the count
+func checkHistogram(t *testing.T, samples map[string]float64, name string, labels string, buckets []float64) {
+	bounds := make([]string, 0, len(buckets)+1)
+	for _, bound := range buckets {
+		bounds = append(bounds, formatFloat(bound))
+	}
+	bounds = append(bounds, "+Inf")
+
+	previous := 0.0
+	for _, le := range bounds {
+		key := fmt.Sprintf("%s_bucket{%sle=\"%s\"}", name, labels, le)
+		value, ok := samples[key]
+		if !ok {
+			t.Fatalf("missing %s", key)
+		}
+		if value < previous {
+			t.Fatalf("%s is %g, below the bucket before it at %g", key, value, previous)
+		}
+		previous = value
+	}
+
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	if count := samples[name+"_count"+labels]; count != previous {
+		t.Fatalf("%s count is %g, +Inf bucket %g", name, count, previous)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	sessions, server := newTestServer(t)
+
+	inputs := Metrics.InputsReceived.Value()
+
+	// One session waiting for players and one played through
+	waiting := sessions.RequestCreate(RulePresets["classic"])
+	if waiting == nil {
+		t.Fatal("could not create a session")
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			if err := playTestClient(server, 1, 30); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	clients.Wait()
+
+	// Ticks of the waiting session are observed once it ran for a bit
+	time.Sleep(5 * SESSION_DELTA_TIME)
+	samples := scrapeMetrics(t, server.URL)
+
+	for _, name := range []string{
+		"pong_sessions_active",
+		`pong_players_connected{kind="player"}`,
+		`pong_players_connected{kind="bot"}`,
+		`pong_players_connected{kind="disconnected"}`,
+		"pong_spectators_connected",
+		"pong_ticks_late_total",
+		"pong_ticks_missed_total",
+		"pong_inputs_received_total",
+		"pong_malformed_messages_total",
+		`pong_websocket_errors_total{op="handshake"}`,
+		`pong_websocket_errors_total{op="read"}`,
+		`pong_websocket_errors_total{op="write"}`,
+	} {
+		if _, ok := samples[name]; !ok {
+			t.Fatalf("missing %s", name)
+		}
+	}
+
+	for _, outcome := range GAME_OUTCOMES {
+		if _, ok := samples[fmt.Sprintf("pong_games_completed_total{outcome=\"%s\"}", outcome)]; !ok {
+			t.Fatalf("missing games completed with outcome %s", outcome)
+		}
+	}
+
+	if active := samples["pong_sessions_active"]; active < 1 {
+		t.Fatalf("%g sessions active, the waiting session is running", active)
+	}
+
+	if received := samples["pong_inputs_received_total"]; received <= float64(inputs) {
+		t.Fatalf("inputs received went from %d to %g while playing", inputs, received)
+	}
+
+	checkHistogram(t, samples, "pong_frame_bytes", "", FRAME_BYTES_BUCKETS)
+	if samples["pong_frame_bytes_count"] == 0 {
+		t.Fatalf("no frames observed while playing")
+	}
+
+	checkHistogram(t, samples, "pong_tick_duration_seconds", fmt.Sprintf("session=\"%d\",", waiting.Id), TICK_DURATION_BUCKETS)
+}
+
+// Connections the server closes itself, here by stopping, are not counted as read errors
+func TestServerClosesAreNotReadErrors(t *testing.T) {
+	sessions, server := newTestServer(t)
+	readErrors := Metrics.ReadErrors.Value()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/play?id=1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(HelloMessage{Type: "hello", Version: PROTOCOL_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	var welcome WelcomeMessage
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Drain <- 0
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Fatalf("read %v, expected the server to restart", err)
+			}
+			break
+		}
+	}
+
+	// The handler notices the closed connection after the session stopped
+	<-sessions.Stopped
+	time.Sleep(100 * time.Millisecond)
+	if count := Metrics.ReadErrors.Value(); count != readErrors {
+		t.Fatalf("read errors went from %d to %d", readErrors, count)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Layout of exported sessions, the exporting and the importing server have to agree on it
+const MIGRATION_VERSION = 1
+
+// Sent to the players of a session that moved to another server. The reason is the address to
+// reconnect to with the session id and their token, empty if the address stays the same
+const CLOSE_SESSION_MOVED = 4003
+
+type PlayerExport struct {
+	Id               int32
+	ProfileId        string
+	Slot             int
+	Team             uint8
+	X                float32
+	Width            float32
+	Token            string
+	InputStates      []InputState
+	ReceivedSequence uint32
+	ViewTick         uint32
+	Bot              *BotController // Nil for players, who reconnect with their token
+}
+
+// Everything needed to resume a session in another process. Snapshot, lag and rollback
+// histories are left out, clients get a full snapshot when they reconnect
+type SessionExport struct {
+	Version            int
+	Id                 int
+	Seed               int64
+	Rules              Rules
+	Clock              time.Time
+	PausedState        GameState
+	PausedShouldUpdate bool
+	Sim                SimState
+	Players            []PlayerExport
+}
+
+// Freezes the session, it ends once its state is written to the path
+type ExportRequest struct {
+	Path     string
+	Redirect string
+	Result   chan error
+}
+
+type ImportRequest struct {
+	Session *GameSession
+	Result  chan error
+}
+
+// Only call from the session goroutine
+func (gs *GameSession) ExportState() SessionExport {
+	export := SessionExport{
+		Version:            MIGRATION_VERSION,
+		Id:                 gs.Id,
+		Seed:               gs.Seed,
+		Rules:              gs.Rules,
+		Clock:              gs.Clock.Now(),
+		PausedState:        gs.PausedState,
+		PausedShouldUpdate: gs.PausedShouldUpdate,
+		Players:            make([]PlayerExport, 0, len(gs.Players)),
+	}
+	gs.SaveState(&export.Sim)
+
+	for _, player := range gs.Slots {
+		if player == nil {
+			continue
+		}
+
+		bot, _ := player.Controller.(*BotController)
+		export.Players = append(export.Players, PlayerExport{
+			Id:               player.Id,
+			ProfileId:        player.ProfileId,
+			Slot:             player.Slot,
+			Team:             player.Team,
+			X:                player.X,
+			Width:            player.Width,
+			Token:            player.Token,
+			InputStates:      player.InputStates,
+			ReceivedSequence: player.ReceivedSequence,
+			ViewTick:         player.ViewTick,
+			Bot:              bot,
+		})
+	}
+
+	return export
+}
+
+func (gs *GameSession) WriteExport(path string) error {
+	// Late inputs that are still pending would otherwise be applied on the next tick only
+	gs.ApplyRollback()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(file).Encode(gs.ExportState()); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Builds a session from an export. Its players hold their seats with the game paused until
+// they reconnect, the replay of the game stays with the server that exported it
+func ImportSession(export SessionExport) (*GameSession, error) {
+	if export.Version != MIGRATION_VERSION {
+		return nil, fmt.Errorf("unsupported migration version %d, server speaks %d", export.Version, MIGRATION_VERSION)
+	}
+
+	// Exports are written by another process, nothing in them is taken on trust
+	if err := export.Rules.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+
+	if len(export.Players) > export.Rules.MaxPlayers() {
+		return nil, fmt.Errorf("%d players, the rules allow %d", len(export.Players), export.Rules.MaxPlayers())
+	}
+
+	if len(export.Sim.Balls) > int(export.Rules.MaxBalls) {
+		return nil, fmt.Errorf("%d balls, the rules allow %d", len(export.Sim.Balls), export.Rules.MaxBalls)
+	}
+
+	if len(export.Sim.PowerUps) > MAX_POWER_UPS {
+		return nil, fmt.Errorf("%d power-ups, at most %d can be on the court", len(export.Sim.PowerUps), MAX_POWER_UPS)
+	}
+
+	gs := NewGameSession(export.Id, export.Seed, export.Rules)
+	gs.Imported = true
+
+	for _, playerExport := range export.Players {
+		slot := playerExport.Slot
+		if slot < 0 || slot >= export.Rules.MaxPlayers() || gs.Slots[slot] != nil || playerExport.Team != SlotSide(slot) {
+			return nil, fmt.Errorf("invalid slot %d for player %d", slot, playerExport.Id)
+		}
+
+		if _, ok := gs.Players[playerExport.Id]; ok {
+			return nil, fmt.Errorf("duplicate player %d", playerExport.Id)
+		}
+
+		player := NewPlayer(nil, gs)
+		if playerExport.Bot != nil {
+			player.Controller = playerExport.Bot
+		}
+		player.Id = playerExport.Id
+		player.ProfileId = playerExport.ProfileId
+		player.Slot = playerExport.Slot
+		player.Team = playerExport.Team
+		player.X = playerExport.X
+		player.Width = playerExport.Width
+		player.Token = playerExport.Token
+		player.InputStates = append(player.InputStates, playerExport.InputStates...)
+		player.ReceivedSequence = playerExport.ReceivedSequence
+		player.ViewTick = playerExport.ViewTick
+
+		gs.Players[player.Id] = player
+		gs.Slots[player.Slot] = player
+	}
+
+	// Restoring moves the clock by the ticks in between, so it is set afterwards
+	gs.RestoreState(&export.Sim)
+	gs.Clock = NewTickClock(export.Clock)
+	gs.PausedState = export.PausedState
+	gs.PausedShouldUpdate = export.PausedShouldUpdate
+	gs.Rollbacks.Invalidate(gs.Tick + 1)
+
+	for _, player := range gs.Slots {
+		if player != nil && player.Controller == nil {
+			gs.HoldSeat(player)
+		}
+	}
+
+	return gs, nil
+}
+
+func LoadExport(path string) (*GameSession, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var export SessionExport
+	if err := json.NewDecoder(file).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	return ImportSession(export)
+}
+
+// Writes the state of a running session to the path and sends its players to the redirect address
+func (sessions *Sessions) Export(id int, path string, redirect string) error {
+	session := sessions.Find(id, nil).Session
+	if session == nil {
+		return errors.New("session not found")
+	}
+
+	request := ExportRequest{Path: path, Redirect: redirect, Result: make(chan error, 1)}
+	select {
+	case session.Export <- request:
+		return <-request.Result
+	case <-session.Done:
+		return errors.New("session ended")
+	}
+}
+
+// Resumes an exported session under its id
+func (sessions *Sessions) Import(path string) (int, error) {
+	session, err := LoadExport(path)
+	if err != nil {
+		return 0, err
+	}
+
+	request := ImportRequest{Session: session, Result: make(chan error, 1)}
+	select {
+	case sessions.ImportSession <- request:
+		return session.Id, <-request.Result
+	case <-sessions.Stopped:
+		return 0, errors.New("server is shutting down")
+	}
+}
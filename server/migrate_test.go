@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Exports the session through JSON like the admin socket does, and imports it again
+func roundTripExport(t *testing.T, export SessionExport) (*GameSession, error) {
+	data, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded SessionExport
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return ImportSession(decoded)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	rules := RulePresets["doubles"]
+	exported := newTestSession(9, rules)
+	startTestGame(t, exported)
+
+	step := func(gs *GameSession, sequences map[int32]uint32) {
+		for _, player := range gs.Slots {
+			if input, ok := testInput(player.Id, gs.Tick, sequences[player.Id]+1); ok {
+				sequences[player.Id]++
+				gs.AddPlayerInput(input)
+			}
+		}
+		gs.Step()
+	}
+
+	sequences := make(map[int32]uint32)
+	for i := 0; i < 300; i++ {
+		step(exported, sequences)
+	}
+
+	imported, err := roundTripExport(t, exported.ExportState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The players reconnect and the game goes on where it was exported
+	if imported.State != Paused {
+		t.Fatalf("imported session is %v, expected paused until the players are back", imported.State)
+	}
+	for _, player := range imported.Slots {
+		player.Controller = &ReplayController{}
+		imported.RestoreSeat(player)
+	}
+
+	importedSequences := make(map[int32]uint32)
+	for id, sequence := range sequences {
+		importedSequences[id] = sequence
+	}
+
+	var expected, actual SimState
+	for i := 0; i < 300; i++ {
+		step(exported, sequences)
+		step(imported, importedSequences)
+
+		exported.SaveState(&expected)
+		imported.SaveState(&actual)
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("imported state differs at tick %d:\n%+v\n%+v", exported.Tick, expected, actual)
+		}
+	}
+}
+
+func TestImportRejectsInvalidExports(t *testing.T) {
+	gs := newTestSession(3, RulePresets["classic"])
+	startTestGame(t, gs)
+
+	cases := map[string]func(export *SessionExport){
+		"version":        func(export *SessionExport) { export.Version++ },
+		"rules":          func(export *SessionExport) { export.Rules.BallSpeed = -1 },
+		"slot":           func(export *SessionExport) { export.Players[1].Slot = 2 },
+		"same slot":      func(export *SessionExport) { export.Players[1].Slot = export.Players[0].Slot },
+		"team":           func(export *SessionExport) { export.Players[0].Team = 1 - export.Players[0].Team },
+		"same player":    func(export *SessionExport) { export.Players[1].Id = export.Players[0].Id },
+		"players":        func(export *SessionExport) { export.Players = append(export.Players, export.Players[0]) },
+		"balls":          func(export *SessionExport) { export.Sim.Balls = make([]Ball, export.Rules.MaxBalls+1) },
+		"power-ups":      func(export *SessionExport) { export.Sim.PowerUps = make([]PowerUp, MAX_POWER_UPS+1) },
+		"spawn interval": func(export *SessionExport) { export.Rules.BallSpawnInterval = -1 },
+	}
+
+	for name, corrupt := range cases {
+		export := gs.ExportState()
+		export.Players = append([]PlayerExport(nil), export.Players...)
+		corrupt(&export)
+
+		if _, err := roundTripExport(t, export); err == nil {
+			t.Fatalf("%s: invalid export was imported", name)
+		}
+	}
+
+	if _, err := roundTripExport(t, gs.ExportState()); err != nil {
+		t.Fatalf("valid export: %s", err)
+	}
+}
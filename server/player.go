@@ -1,8 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,11 +17,40 @@ const PLAYER_SPEED = 100
 const PLAYER_WIDTH = 10
 const PLAYER_HEIGHT = 100
 
+// Client messages are an input or an acknowledged snapshot tick on its own
+const INPUT_MESSAGE_SIZE = 14
+const ACK_MESSAGE_SIZE = 4
+
+// Inputs can be scheduled up to half a second ahead of the session
+const MAX_INPUT_LEAD_TICKS = 30
+
+// Malformed messages a client can send in a burst and how many it earns back a second,
+// a client going over is disconnected with a policy violation
+const MALFORMED_BURST = 10
+const MALFORMED_PER_SECOND = 1
+
+// Late inputs spend a tenth of the budget, clients on a jittery connection send a few
+const LATE_INPUT_COST = 0.1
+
+// Largest message read from a client, the hello is the longest one a real client sends
+const MAX_MESSAGE_SIZE = 256
+
+// A client message that is not an input or an ack
+type MessageError struct {
+	Size   int
+	Reason string
+}
+
+func (err *MessageError) Error() string {
+	return fmt.Sprintf("%s (%d bytes)", err.Reason, err.Size)
+}
+
 type InputState struct {
 	UpPressed   bool
 	DownPressed bool
-	Timestamp   time.Time
-	Sequence    uint32
+	Tick        uint32 // Session tick the input applies from, as predicted by the client
+	Sequence    uint32 // Counts every input the client sent, starting from one
+	AckTick     uint32 // Last snapshot tick the client had when sending the input
 }
 
 type InputUpdate struct {
@@ -25,76 +59,248 @@ type InputUpdate struct {
 }
 
 type Controller interface {
+	OnJoin(playerId int32, session *GameSession)
 	OnUpdate(dt float32, playerId int32, session *GameSession)
 }
 
 type PlayerController struct {
 	Connection *websocket.Conn
+
+	// Last snapshot tick the client received, zero until it acknowledges one or after it lost sync
+	AckTick atomic.Uint32
+
+	// Smoothed round trip time and its mean deviation in nanoseconds, zero until the first pong
+	Rtt    atomic.Int64
+	Jitter atomic.Int64
+
+	// Written by the writer goroutine, so a slow client never holds up the session
+	Outbox  chan OutgoingMessage
+	Dropped uint32 // Frames dropped in a row, only touched by the session
+	Done    chan struct{}
+	stop    sync.Once
+
+	// Set when this side closed the connection, reading then fails without the client being at fault
+	hungUp atomic.Bool
+
+	// Replaced with one carrying the session and player id once the client joined
+	logger atomic.Pointer[slog.Logger]
+
+	// Budget of malformed messages left and when it was last spent, only touched by the reading goroutine
+	Malformed   float64
+	MalformedAt time.Time
 }
 
 type Player struct {
-	Id          int32
-	Controller  Controller
-	Score       int32
-	X           float32
-	Y           float32
-	InputStates []InputState
-	Session     *GameSession
-	Ready       chan bool
+	Id               int32
+	ProfileId        string
+	Controller       Controller
+	Slot             int
+	Team             uint8 // Side of the court, 0 defends the left goal and 1 the right
+	X                float32
+	Y                float32
+	Width            float32
+	Height           float32
+	Effects          []Effect
+	Shield           bool
+	InputStates      []InputState // Received inputs in tick order, rollback sessions keep applied ones for the window
+	Input            InputState   // Input applied during the last tick, its sequence is acknowledged to the client
+	ReceivedSequence uint32
+	ViewTick         uint32
+	Rtt              time.Duration // Taken from the controller every tick, recorded for replays
+	Jitter           time.Duration
+	Session          *GameSession
+	Ready            chan bool
+
+	// Presented to /play to take the seat back after the connection dropped
+	Token          string
+	Disconnected   bool
+	DisconnectedAt uint32
+}
+
+// Receives the same frames as the players, but never takes a paddle
+type Spectator struct {
+	Controller *PlayerController
+	Session    *GameSession
+}
+
+// Held buttons, so clients can predict other players with the input they last had
+func (input *InputState) Flags() uint8 {
+	var flags uint8 = 0
+	if input.UpPressed {
+		flags |= 1
+	}
+	if input.DownPressed {
+		flags |= 2
+	}
+
+	return flags
+}
+
+func NewPlayer(controller Controller, session *GameSession) *Player {
+	return &Player{
+		Controller:  controller,
+		Team:        0,
+		X:           0,
+		Y:           0,
+		Session:     session,
+		InputStates: make([]InputState, 0),
+		Effects:     make([]Effect, 0),
+		Ready:       make(chan bool),
+	}
+}
+
+// Round trip time for the state frame, in milliseconds
+func (player *Player) RttMillis() uint16 {
+	return uint16(min(player.Rtt.Milliseconds(), math.MaxUint16))
 }
 
 func NewPlayerController(conn *websocket.Conn) *PlayerController {
-	return &PlayerController{
+	controller := &PlayerController{
 		Connection: conn,
+		Outbox:     make(chan OutgoingMessage, SEND_QUEUE_SIZE),
+		Done:       make(chan struct{}),
 	}
+	controller.logger.Store(slog.Default().With("remote", conn.RemoteAddr().String()))
+	conn.SetPongHandler(controller.OnPong)
+	go controller.Write()
+
+	return controller
 }
 
-func (pc *PlayerController) OnUpdate(dt float32, playerId int32, session *GameSession) {
-	var playerBuffer bytes.Buffer
-	if err := binary.Write(&playerBuffer, binary.LittleEndian, playerId); err != nil {
-		panic(err)
+// Smooths the round trip time like TCP does, called from the goroutine reading the connection
+func (pc *PlayerController) OnPong(appData string) error {
+	KeepAlive(pc.Connection)
+
+	if len(appData) != 8 {
+		return nil
 	}
 
-	player := session.Players[playerId]
+	sent := time.Unix(0, int64(binary.LittleEndian.Uint64([]byte(appData))))
+	sample := time.Since(sent)
+	if sample < 0 {
+		return nil
+	}
 
-	var lastSequence uint32 = 0
-	if len(player.InputStates) > 0 {
-		lastSequence = player.InputStates[len(player.InputStates)-1].Sequence
+	rtt := time.Duration(pc.Rtt.Load())
+	jitter := time.Duration(pc.Jitter.Load())
+	if rtt == 0 {
+		rtt, jitter = sample, sample/2
+	} else {
+		deviation := sample - rtt
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		jitter += (deviation - jitter) / 4
+		rtt += (sample - rtt) / 8
 	}
 
-	if err := binary.Write(&playerBuffer, binary.LittleEndian, lastSequence); err != nil {
-		panic(err)
+	pc.Rtt.Store(int64(rtt))
+	pc.Jitter.Store(int64(jitter))
+	return nil
+}
+
+func (pc *PlayerController) Log() *slog.Logger {
+	return pc.logger.Load()
+}
+
+func (pc *PlayerController) Latency() (time.Duration, time.Duration) {
+	return time.Duration(pc.Rtt.Load()), time.Duration(pc.Jitter.Load())
+}
+
+// Welcomes the client with its id, side and the session rules, before the first state frame
+func (pc *PlayerController) OnJoin(playerId int32, session *GameSession) {
+	pc.AckTick.Store(0)
+	pc.logger.Store(session.Logger.With("player", playerId, "remote", pc.Connection.RemoteAddr().String()))
+
+	welcome, err := json.Marshal(NewWelcomeMessage(playerId, session))
+	if err != nil {
+		pc.Log().Error("Could not encode welcome", "error", err)
+		return
+	}
+	pc.Send(websocket.TextMessage, welcome)
+}
+
+// Sends a delta against the last acknowledged snapshot, or a full one if the client has none
+func (pc *PlayerController) OnUpdate(dt float32, playerId int32, session *GameSession) {
+	// The frame is only valid until the next one is encoded
+	frame := session.Frame(playerId, pc.AckTick.Load())
+	pc.Send(websocket.BinaryMessage, append([]byte(nil), frame...))
+}
+
+// Reads the tick acknowledged by an input or an ack on its own, reports if the message was only an ack
+func (pc *PlayerController) ReadAck(p []byte) bool {
+	if len(p) == ACK_MESSAGE_SIZE || len(p) == INPUT_MESSAGE_SIZE {
+		pc.AckTick.Store(binary.LittleEndian.Uint32(p[len(p)-ACK_MESSAGE_SIZE:]))
 	}
 
-	playerBuffer.Write(session.StateBuffer.Bytes())
-	pc.Connection.WriteMessage(websocket.BinaryMessage, playerBuffer.Bytes())
+	return len(p) == ACK_MESSAGE_SIZE
 }
 
-func ReadInput(p []byte, playerId int32) InputUpdate {
-	var rawInputState struct {
-		UpPressed   byte
-		DownPressed byte
-		Timestamp   int64 // Retrieved on client side using Date.now()
-		Sequence    uint32
+// Checks the type and size of a client message, players send inputs and acks, spectators only acks
+func CheckMessage(mt int, p []byte, inputs bool) error {
+	if mt != websocket.BinaryMessage {
+		return &MessageError{Size: len(p), Reason: "expected a binary message"}
 	}
 
-	if err := binary.Read(bytes.NewReader(p), binary.LittleEndian, &rawInputState); err != nil {
-		panic(err)
+	if len(p) != ACK_MESSAGE_SIZE && (!inputs || len(p) != INPUT_MESSAGE_SIZE) {
+		return &MessageError{Size: len(p), Reason: "unexpected message size"}
 	}
 
-	timestamp := time.Unix(0, rawInputState.Timestamp*int64(time.Millisecond))
-	// Get server timestamp, if it's in the future, use it instead
-	if timestamp.After(time.Now()) || timestamp.Before(time.Now().Add(-1*time.Second)) {
-		timestamp = time.Now()
+	return nil
+}
+
+func ReadInput(p []byte, playerId int32) (InputUpdate, error) {
+	if len(p) != INPUT_MESSAGE_SIZE {
+		return InputUpdate{}, &MessageError{Size: len(p), Reason: "unexpected input size"}
+	}
+
+	// Buttons are sent as a byte each, anything but zero or one is not from a real client
+	if p[0] > 1 || p[1] > 1 {
+		return InputUpdate{}, &MessageError{Size: len(p), Reason: "invalid button state"}
 	}
 
 	return InputUpdate{
 		PlayerId: playerId,
 		InputState: InputState{
-			UpPressed:   rawInputState.UpPressed == 1,
-			DownPressed: rawInputState.DownPressed == 1,
-			Timestamp:   timestamp,
-			Sequence:    rawInputState.Sequence,
+			UpPressed:   p[0] == 1,
+			DownPressed: p[1] == 1,
+			Sequence:    binary.LittleEndian.Uint32(p[2:6]),
+			Tick:        binary.LittleEndian.Uint32(p[6:10]),
+			AckTick:     binary.LittleEndian.Uint32(p[10:14]),
 		},
+	}, nil
+}
+
+// Counts a malformed message against the budget of the client, reports if the client used it up
+// and should be disconnected. Only call from the goroutine reading the connection
+func (pc *PlayerController) Reject(err error) bool {
+	Metrics.MalformedMessages.Add(1)
+
+	if pc.Spend(1) {
+		pc.Log().Warn("Too many malformed messages", "error", err)
+		return true
 	}
+
+	pc.Log().Debug("Malformed message", "error", err)
+	return false
+}
+
+// Counts an input for a tick the session already simulated against the same budget, each one makes
+// a rollback session simulate again. Only call from the goroutine reading the connection
+func (pc *PlayerController) RejectLate(input InputState, sessionTick uint32) bool {
+	if input.Tick > sessionTick || !pc.Spend(LATE_INPUT_COST) {
+		return false
+	}
+
+	pc.Log().Warn("Too many late inputs", "inputTick", input.Tick, "sessionTick", sessionTick)
+	return true
+}
+
+// Takes the cost from the budget, which refills over time, and reports if it is used up
+func (pc *PlayerController) Spend(cost float64) bool {
+	now := time.Now()
+	pc.Malformed = min(MALFORMED_BURST, pc.Malformed+now.Sub(pc.MalformedAt).Seconds()*MALFORMED_PER_SECOND) - cost
+	pc.MalformedAt = now
+
+	return pc.Malformed < 0
 }
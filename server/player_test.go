@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRejectBudget(t *testing.T) {
+	pc := &PlayerController{}
+	pc.logger.Store(slog.Default())
+
+	for i := 0; i < MALFORMED_BURST; i++ {
+		if pc.Reject(&MessageError{Reason: "test"}) {
+			t.Fatalf("kicked after %d malformed messages, the burst is %d", i+1, MALFORMED_BURST)
+		}
+	}
+	if !pc.Reject(&MessageError{Reason: "test"}) {
+		t.Fatalf("not kicked past the burst of %d", MALFORMED_BURST)
+	}
+
+	// The budget refills over time
+	pc.MalformedAt = pc.MalformedAt.Add(-2 * time.Second / MALFORMED_PER_SECOND)
+	if pc.Reject(&MessageError{Reason: "test"}) {
+		t.Fatalf("kicked after the budget refilled")
+	}
+}
+
+func TestLateInputsSpendBudget(t *testing.T) {
+	pc := &PlayerController{}
+	pc.logger.Store(slog.Default())
+
+	if pc.RejectLate(InputState{Tick: 101}, 100) || pc.Malformed != 0 {
+		t.Fatalf("input ahead of the session spent the budget")
+	}
+
+	kicked := 0
+	for i := 0; i < int(MALFORMED_BURST/LATE_INPUT_COST)+5; i++ {
+		if pc.RejectLate(InputState{Tick: 90}, 100) {
+			kicked = i + 1
+			break
+		}
+	}
+	if kicked == 0 || kicked < int(MALFORMED_BURST/LATE_INPUT_COST) {
+		t.Fatalf("kicked after %d late inputs, the burst is %g", kicked, MALFORMED_BURST/LATE_INPUT_COST)
+	}
+
+	// Malformed messages spend the same budget
+	pc.Malformed, pc.MalformedAt = 0.5, time.Now()
+	if !pc.Reject(&MessageError{Reason: "test"}) {
+		t.Fatalf("not kicked after late inputs used up the budget")
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	cases := []struct {
+		name   string
+		mt     int
+		size   int
+		inputs bool
+		ok     bool
+	}{
+		{"ack", websocket.BinaryMessage, ACK_MESSAGE_SIZE, true, true},
+		{"input", websocket.BinaryMessage, INPUT_MESSAGE_SIZE, true, true},
+		{"spectator ack", websocket.BinaryMessage, ACK_MESSAGE_SIZE, false, true},
+		{"spectator input", websocket.BinaryMessage, INPUT_MESSAGE_SIZE, false, false},
+		{"text", websocket.TextMessage, ACK_MESSAGE_SIZE, true, false},
+		{"empty", websocket.BinaryMessage, 0, true, false},
+		{"short", websocket.BinaryMessage, ACK_MESSAGE_SIZE - 1, true, false},
+		{"between", websocket.BinaryMessage, ACK_MESSAGE_SIZE + 1, true, false},
+		{"oversized", websocket.BinaryMessage, MAX_MESSAGE_SIZE, true, false},
+	}
+
+	for _, c := range cases {
+		if err := CheckMessage(c.mt, make([]byte, c.size), c.inputs); (err == nil) != c.ok {
+			t.Fatalf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	message := []byte{1, 0}
+	message = binary.LittleEndian.AppendUint32(message, 7)
+	message = binary.LittleEndian.AppendUint32(message, 120)
+	message = binary.LittleEndian.AppendUint32(message, 118)
+
+	input, err := ReadInput(message, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := InputUpdate{PlayerId: 3, InputState: InputState{UpPressed: true, Sequence: 7, Tick: 120, AckTick: 118}}
+	if input != expected {
+		t.Fatalf("read %+v, expected %+v", input, expected)
+	}
+
+	for name, p := range map[string][]byte{
+		"empty":        {},
+		"short":        message[:INPUT_MESSAGE_SIZE-1],
+		"oversized":    append(append([]byte(nil), message...), 0),
+		"button state": append([]byte{2}, message[1:]...),
+	} {
+		if _, err := ReadInput(p, 3); err == nil {
+			t.Fatalf("%s input was read", name)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+type PowerUpType uint8
+
+const (
+	EnlargePaddle PowerUpType = iota
+	ShrinkPaddle
+	SlowBall
+	CurveBall
+	Shield
+	NumPowerUpTypes
+)
+
+const POWER_UP_RADIUS = 15
+const MAX_POWER_UPS = 3
+
+// How long an uncollected power-up stays in the court, and how long paddle effects last
+const POWER_UP_LIFETIME = 10 * time.Second
+const POWER_UP_EFFECT_TIME = 8 * time.Second
+
+const ENLARGE_FACTOR = 1.5
+const SHRINK_FACTOR = 0.6
+const SLOW_FACTOR = 0.6
+
+// Vertical acceleration of a curve ball, until it hits a paddle
+const CURVE_ACCELERATION = 250
+
+type PowerUp struct {
+	Type PowerUpType
+	X    float32
+	Y    float32
+	Age  time.Duration
+}
+
+// Timed effect on a player paddle
+type Effect struct {
+	Type      PowerUpType
+	Remaining time.Duration
+}
+
+// Spawns power-ups in the middle half of the court, where both sides can reach them
+func (gs *GameSession) SpawnPowerUp() {
+	if len(gs.PowerUps) >= MAX_POWER_UPS {
+		return
+	}
+
+	gs.PowerUps = append(gs.PowerUps, PowerUp{
+		Type: PowerUpType(gs.Rand.Intn(int(NumPowerUpTypes))),
+		X:    gs.Rules.CourtWidth/4 + gs.Rand.Float32()*gs.Rules.CourtWidth/2,
+		Y:    POWER_UP_RADIUS + gs.Rand.Float32()*(gs.Rules.CourtHeight-2*POWER_UP_RADIUS),
+	})
+	gs.Events.PowerUpSpawned = true
+}
+
+// Ages power-ups and effects, and resizes paddles around their center
+func (gs *GameSession) UpdatePowerUps(dt time.Duration) {
+	active := gs.PowerUps[:0]
+	for _, powerUp := range gs.PowerUps {
+		powerUp.Age += dt
+		if powerUp.Age < POWER_UP_LIFETIME {
+			active = append(active, powerUp)
+		}
+	}
+	gs.PowerUps = active
+
+	for _, player := range gs.Players {
+		effects := player.Effects[:0]
+		height := gs.Rules.PlayerHeight
+		for _, effect := range player.Effects {
+			effect.Remaining -= dt
+			if effect.Remaining <= 0 {
+				continue
+			}
+
+			effects = append(effects, effect)
+			if effect.Type == EnlargePaddle {
+				height *= ENLARGE_FACTOR
+			} else if effect.Type == ShrinkPaddle {
+				height *= SHRINK_FACTOR
+			}
+		}
+		player.Effects = effects
+
+		height = float32(math.Min(float64(height), float64(gs.Rules.CourtHeight)))
+		player.Y = Clamp(player.Y+(player.Height-height)/2, 0, gs.Rules.CourtHeight-height)
+		player.Height = height
+	}
+
+	if !gs.Rules.PowerUps {
+		return
+	}
+
+	gs.PowerUpTime += dt
+	if gs.PowerUpTime.Seconds() >= float64(gs.Rules.PowerUpInterval) {
+		gs.PowerUpTime = 0
+		gs.SpawnPowerUp()
+	}
+}
+
+// Balls that pass through a power-up collect it for the player that hit them last. Fast balls
+// move further than a power-up is wide in a tick, so the whole path from the old position is tested
+func (gs *GameSession) CollectPowerUps(oldBall *Ball, ball *Ball) {
+	collector, ok := gs.Players[ball.LastHitBy]
+	if !ok {
+		return
+	}
+
+	pathX := ball.X - oldBall.X
+	pathY := ball.Y - oldBall.Y
+	pathLength := pathX*pathX + pathY*pathY
+
+	remaining := gs.PowerUps[:0]
+	for _, powerUp := range gs.PowerUps {
+		// Closest point of the path to the power-up
+		t := float32(0)
+		if pathLength > 0 {
+			t = Clamp(((powerUp.X-oldBall.X)*pathX+(powerUp.Y-oldBall.Y)*pathY)/pathLength, 0, 1)
+		}
+
+		dx := oldBall.X + pathX*t - powerUp.X
+		dy := oldBall.Y + pathY*t - powerUp.Y
+		if dx*dx+dy*dy > (BALL_RADIUS+POWER_UP_RADIUS)*(BALL_RADIUS+POWER_UP_RADIUS) {
+			remaining = append(remaining, powerUp)
+			continue
+		}
+
+		gs.ApplyPowerUp(powerUp.Type, collector, ball)
+		gs.Events.PowerUpCollected = true
+	}
+	gs.PowerUps = remaining
+}
+
+func (gs *GameSession) ApplyPowerUp(powerUpType PowerUpType, collector *Player, ball *Ball) {
+	switch powerUpType {
+	case EnlargePaddle:
+		collector.Effects = append(collector.Effects, Effect{Type: EnlargePaddle, Remaining: POWER_UP_EFFECT_TIME})
+	case ShrinkPaddle:
+		for _, player := range gs.Players {
+			if player.Team != collector.Team {
+				player.Effects = append(player.Effects, Effect{Type: ShrinkPaddle, Remaining: POWER_UP_EFFECT_TIME})
+			}
+		}
+	case SlowBall:
+		ball.VelocityX *= SLOW_FACTOR
+		ball.VelocityY *= SLOW_FACTOR
+	case CurveBall:
+		ball.Curve = CURVE_ACCELERATION * float32(gs.Rand.Intn(2)*2-1)
+	case Shield:
+		collector.Shield = true
+	}
+}
+
+// Uses up a shield on the defending team, returns true if the ball was sent back
+func (gs *GameSession) UseShield(ball *Ball, defendingTeam uint8) bool {
+	// In slot order, so the same shield is used up every time the session is simulated
+	for _, player := range gs.Slots {
+		if player == nil || player.Team != defendingTeam || !player.Shield {
+			continue
+		}
+
+		player.Shield = false
+		ball.VelocityX *= -1
+		ball.X = Clamp(ball.X, 0, gs.Rules.CourtWidth)
+		gs.Events.ShieldUsed = true
+		return true
+	}
+
+	return false
+}
+
+// Bit per active effect type, for the state frame
+func (player *Player) EffectFlags() uint8 {
+	var flags uint8 = 0
+	for _, effect := range player.Effects {
+		flags |= 1 << effect.Type
+	}
+
+	if player.Shield {
+		flags |= 1 << Shield
+	}
+
+	return flags
+}
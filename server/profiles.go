@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sync"
+)
+
+const PROFILES_PATH = "profiles.json"
+
+const DEFAULT_RATING = 1500
+const RATING_K_FACTOR = 32
+
+type Profile struct {
+	Id     string  `json:"id"`
+	Name   string  `json:"name"`
+	Rating float64 `json:"rating"`
+	Wins   int     `json:"wins"`
+	Losses int     `json:"losses"`
+}
+
+// Player profiles kept in memory and written to a single file on disk on every change
+type Profiles struct {
+	Path     string
+	Profiles map[string]*Profile
+
+	mutex sync.Mutex
+}
+
+var ErrProfileNotFound = errors.New("profile not found")
+
+func LoadProfiles(path string) (*Profiles, error) {
+	profiles := &Profiles{
+		Path:     path,
+		Profiles: make(map[string]*Profile),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &profiles.Profiles); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// Write to a temporary file first, so a crash never leaves a half written store
+func (p *Profiles) save() error {
+	data, err := json.MarshalIndent(p.Profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.Path)
+}
+
+func (p *Profiles) Get(id string) (Profile, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	profile, ok := p.Profiles[id]
+	if !ok {
+		return Profile{}, false
+	}
+
+	return *profile, true
+}
+
+func (p *Profiles) Create(name string) (Profile, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Profile{}, err
+	}
+
+	profile := &Profile{
+		Id:     hex.EncodeToString(b),
+		Name:   name,
+		Rating: DEFAULT_RATING,
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.Profiles[profile.Id] = profile
+	return *profile, p.save()
+}
+
+// Elo update of both ratings after a finished game
+func (p *Profiles) RecordMatch(winnerId string, loserId string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	winner, ok := p.Profiles[winnerId]
+	if !ok {
+		return ErrProfileNotFound
+	}
+
+	loser, ok := p.Profiles[loserId]
+	if !ok {
+		return ErrProfileNotFound
+	}
+
+	expected := 1 / (1 + math.Pow(10, (loser.Rating-winner.Rating)/400))
+	change := RATING_K_FACTOR * (1 - expected)
+
+	winner.Rating += change
+	loser.Rating -= change
+	winner.Wins++
+	loser.Losses++
+
+	return p.save()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// How long a dropped player keeps its seat, with the game paused
+const RECONNECT_GRACE = 30 * time.Second
+const RECONNECT_GRACE_TICKS = uint32(RECONNECT_GRACE / SESSION_DELTA_TIME)
+
+// Sent by a connection that dropped without closing, the controller tells stale connections apart
+type Disconnect struct {
+	Player     *Player
+	Controller *PlayerController
+}
+
+// Asks the session for the seat of the token, Result gets the player or nil
+type ReconnectRequest struct {
+	Token      string
+	Controller *PlayerController
+	Result     chan *Player
+}
+
+func NewReconnectToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Keeps the seat of a dropped player and pauses the game until it is back
+func (gs *GameSession) HoldSeat(player *Player) {
+	gs.Rollbacks.Invalidate(gs.Tick + 1)
+	gs.Recorder.RecordDisconnect(gs.Tick, player.Id)
+
+	player.Disconnected = true
+	player.DisconnectedAt = gs.Tick
+
+	if gs.State != Paused {
+		gs.PausedState = gs.State
+		gs.PausedShouldUpdate = gs.ShouldUpdate
+		gs.State = Paused
+		gs.ShouldUpdate = false
+	}
+
+	gs.Log().Info("Holding seat", "player", player.Id)
+}
+
+// Gives the seat back, the game goes on once no seat is held anymore
+func (gs *GameSession) RestoreSeat(player *Player) {
+	gs.Rollbacks.Invalidate(gs.Tick + 1)
+	gs.Recorder.RecordReconnect(gs.Tick, player.Id)
+
+	player.Disconnected = false
+	gs.Log().Info("Restored seat", "player", player.Id)
+
+	for _, otherPlayer := range gs.Players {
+		if otherPlayer.Disconnected {
+			return
+		}
+	}
+
+	if gs.State == Paused {
+		gs.State = gs.PausedState
+		gs.ShouldUpdate = gs.PausedShouldUpdate
+	}
+}
+
+// Drops a player for good if the game had not started, otherwise holds its seat
+func (gs *GameSession) HandleDisconnect(disconnect Disconnect) bool {
+	player := disconnect.Player
+	if player.Controller != disconnect.Controller {
+		return false
+	}
+
+	if gs.State == WaitingForPlayers {
+		return gs.HandleUnregister(player)
+	}
+
+	gs.HoldSeat(player)
+	return false
+}
+
+func (gs *GameSession) HandleReconnect(request ReconnectRequest) {
+	for _, player := range gs.Players {
+		if player.Token == "" || player.Token != request.Token {
+			continue
+		}
+
+		// The old connection may not have noticed it dropped yet
+		if old, ok := player.Controller.(*PlayerController); ok && !player.Disconnected {
+			old.HangUp()
+		}
+
+		player.Controller = request.Controller
+		if player.Disconnected {
+			gs.RestoreSeat(player)
+		}
+
+		request.Result <- player
+		player.Controller.OnJoin(player.Id, gs)
+		return
+	}
+
+	request.Result <- nil
+}
+
+// Releases seats held for longer than the grace period, returns true if no human players are left
+func (gs *GameSession) ExpireSeats() bool {
+	for _, player := range gs.Players {
+		if player.Disconnected && gs.Tick-player.DisconnectedAt >= RECONNECT_GRACE_TICKS {
+			gs.Log().Info("Held seat expired", "player", player.Id)
+			if gs.HandleUnregister(player) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHeldSeatsPauseTheGame(t *testing.T) {
+	gs := newTestSession(2, RulePresets["doubles"])
+	startTestGame(t, gs)
+
+	first, second := gs.Slots[0], gs.Slots[3]
+	gs.HoldSeat(first)
+	gs.HoldSeat(second)
+	if gs.State != Paused || gs.ShouldUpdate || gs.PausedState != Running {
+		t.Fatalf("state %v after holding seats, paused from %v", gs.State, gs.PausedState)
+	}
+
+	// Nothing moves while the seats are held
+	balls := append([]Ball(nil), gs.Balls...)
+	for i := 0; i < 30; i++ {
+		gs.Step()
+	}
+	if gs.Balls[0] != balls[0] {
+		t.Fatalf("ball moved while paused")
+	}
+
+	// The game only goes on once every held seat is taken again
+	gs.RestoreSeat(first)
+	if gs.State != Paused {
+		t.Fatalf("game went on with a seat still held")
+	}
+	gs.RestoreSeat(second)
+	if gs.State != Running || !gs.ShouldUpdate {
+		t.Fatalf("state %v after restoring every seat", gs.State)
+	}
+}
+
+func TestHeldSeatsExpire(t *testing.T) {
+	gs := newTestSession(3, RulePresets["classic"])
+	startTestGame(t, gs)
+
+	player := gs.Slots[0]
+	gs.HoldSeat(player)
+
+	gs.Tick += RECONNECT_GRACE_TICKS - 1
+	if gs.ExpireSeats() || gs.Players[player.Id] == nil {
+		t.Fatalf("seat expired before the grace period of %s", RECONNECT_GRACE)
+	}
+
+	gs.Tick++
+	if gs.ExpireSeats() {
+		t.Fatalf("session ended with a player still connected")
+	}
+	if gs.Players[player.Id] != nil || gs.Slots[0] != nil {
+		t.Fatalf("seat still held after the grace period")
+	}
+}
+
+func TestStaleDisconnectIsIgnored(t *testing.T) {
+	gs := newTestSession(4, RulePresets["classic"])
+	startTestGame(t, gs)
+
+	// The player reconnected before the old connection noticed it dropped
+	player := gs.Slots[0]
+	old, current := &PlayerController{}, &PlayerController{}
+	player.Controller = current
+
+	if gs.HandleDisconnect(Disconnect{Player: player, Controller: old}) {
+		t.Fatalf("stale disconnect ended the session")
+	}
+	if player.Disconnected || gs.State == Paused {
+		t.Fatalf("stale disconnect held the seat of a connected player")
+	}
+
+	if gs.HandleDisconnect(Disconnect{Player: player, Controller: current}) {
+		t.Fatalf("disconnect ended the session")
+	}
+	if !player.Disconnected || gs.State != Paused {
+		t.Fatalf("seat not held after the current connection dropped")
+	}
+}
+
+func TestDisconnectBeforeStartGivesSeatUp(t *testing.T) {
+	gs := newTestSession(5, RulePresets["doubles"])
+	gs.HandleUnregister(gs.Slots[3])
+	if gs.State != WaitingForPlayers {
+		t.Fatalf("state %v with a seat free", gs.State)
+	}
+
+	player := gs.Slots[0]
+	controller := &PlayerController{}
+	player.Controller = controller
+	gs.HandleDisconnect(Disconnect{Player: player, Controller: controller})
+	if gs.Players[player.Id] != nil || gs.Slots[0] != nil {
+		t.Fatalf("seat held before the game started")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const REPLAY_DIR = "replays"
+const REPLAY_MAGIC = "PONGREPL"
+const REPLAY_VERSION = 12
+
+// Keyframes let playback snap back to the recorded state, 5 seconds apart
+const REPLAY_KEYFRAME_INTERVAL = 300
+
+var ErrReplayStopped = errors.New("replay stopped")
+
+type ReplayEventType uint8
+
+const (
+	ReplayJoin ReplayEventType = iota
+	ReplayLeave
+	ReplayInput
+	ReplayKeyframe
+	ReplayDisconnect
+	ReplayReconnect
+	ReplayLatency
+)
+
+// Followed by the session rules as length prefixed JSON
+type ReplayHeader struct {
+	Magic      [8]byte
+	Version    uint8
+	SessionId  int64
+	Seed       int64
+	ClockStart int64 // Unix nanoseconds of the session clock at tick 0
+}
+
+// Everything a session reacts to, stamped with the tick it happened after
+type ReplayEvent struct {
+	Type     ReplayEventType
+	Tick     uint32
+	PlayerId int32
+	IsBot    bool
+	Input    InputState
+	State    []byte
+	Rtt      time.Duration
+	Jitter   time.Duration
+}
+
+type ReplayRecorder struct {
+	Name   string
+	File   *os.File
+	Writer *bufio.Writer
+	Played bool // A human joined, replays of sessions nobody played are removed when they end
+}
+
+type Replay struct {
+	Header    ReplayHeader
+	Rules     Rules
+	Events    []ReplayEvent
+	Keyframes map[uint32][]byte
+}
+
+// Players in a replay are driven by the recorded inputs only
+type ReplayController struct{}
+
+func (rc *ReplayController) OnJoin(playerId int32, session *GameSession) {}
+
+func (rc *ReplayController) OnUpdate(dt float32, playerId int32, session *GameSession) {}
+
+// Session ids are chosen by the clients and reused, the seed tells apart the sessions that had the id
+var replayNamePattern = regexp.MustCompile(`^-?[0-9]+-[0-9]+$`)
+
+func ReplayName(id int, seed int64) string {
+	return fmt.Sprintf("%d-%d", id, seed)
+}
+
+// Path of the replay with the name, false if the name is not one ReplayName gives
+func ReplayPath(name string) (string, bool) {
+	if !replayNamePattern.MatchString(name) {
+		return "", false
+	}
+
+	return filepath.Join(REPLAY_DIR, name+".replay"), true
+}
+
+// Name of the newest replay of the session id, seeds are taken from the clock so the largest one is the latest
+func LatestReplay(id int) (string, bool) {
+	paths, err := filepath.Glob(filepath.Join(REPLAY_DIR, fmt.Sprintf("%d-*.replay", id)))
+	if err != nil {
+		return "", false
+	}
+
+	latest, latestSeed := "", int64(0)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".replay")
+		if !replayNamePattern.MatchString(name) {
+			continue
+		}
+
+		seed, err := strconv.ParseInt(strings.TrimPrefix(name, fmt.Sprintf("%d-", id)), 10, 64)
+		if err != nil {
+			continue
+		}
+		if latest == "" || seed > latestSeed {
+			latest, latestSeed = name, seed
+		}
+	}
+
+	return latest, latest != ""
+}
+
+func NewReplayRecorder(session *GameSession) (*ReplayRecorder, error) {
+	if err := os.MkdirAll(REPLAY_DIR, 0755); err != nil {
+		return nil, err
+	}
+
+	name := ReplayName(session.Id, session.Seed)
+	path, _ := ReplayPath(name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &ReplayRecorder{
+		Name:   name,
+		File:   file,
+		Writer: bufio.NewWriter(file),
+	}
+
+	header := ReplayHeader{
+		Version:    REPLAY_VERSION,
+		SessionId:  int64(session.Id),
+		Seed:       session.Seed,
+		ClockStart: session.Clock.Now().UnixNano(),
+	}
+	copy(header.Magic[:], REPLAY_MAGIC)
+
+	if err := binary.Write(recorder.Writer, binary.LittleEndian, header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	rules, err := json.Marshal(session.Rules)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	binary.Write(recorder.Writer, binary.LittleEndian, uint32(len(rules)))
+	recorder.Writer.Write(rules)
+
+	return recorder, nil
+}
+
+func (rr *ReplayRecorder) write(eventType ReplayEventType, tick uint32, data any) {
+	if rr == nil {
+		return
+	}
+
+	binary.Write(rr.Writer, binary.LittleEndian, eventType)
+	binary.Write(rr.Writer, binary.LittleEndian, tick)
+	if data != nil {
+		binary.Write(rr.Writer, binary.LittleEndian, data)
+	}
+}
+
+func (rr *ReplayRecorder) RecordJoin(tick uint32, playerId int32, isBot bool) {
+	if rr != nil && !isBot {
+		rr.Played = true
+	}
+
+	var bot byte = 0
+	if isBot {
+		bot = 1
+	}
+
+	rr.write(ReplayJoin, tick, struct {
+		PlayerId int32
+		IsBot    byte
+	}{playerId, bot})
+}
+
+func (rr *ReplayRecorder) RecordLeave(tick uint32, playerId int32) {
+	rr.write(ReplayLeave, tick, playerId)
+}
+
+func (rr *ReplayRecorder) RecordInput(tick uint32, inputUpdate InputUpdate) {
+	var up, down byte = 0, 0
+	if inputUpdate.InputState.UpPressed {
+		up = 1
+	}
+	if inputUpdate.InputState.DownPressed {
+		down = 1
+	}
+
+	rr.write(ReplayInput, tick, struct {
+		PlayerId    int32
+		UpPressed   byte
+		DownPressed byte
+		Tick        uint32
+		Sequence    uint32
+		AckTick     uint32
+	}{
+		PlayerId:    inputUpdate.PlayerId,
+		UpPressed:   up,
+		DownPressed: down,
+		Tick:        inputUpdate.InputState.Tick,
+		Sequence:    inputUpdate.InputState.Sequence,
+		AckTick:     inputUpdate.InputState.AckTick,
+	})
+}
+
+func (rr *ReplayRecorder) RecordDisconnect(tick uint32, playerId int32) {
+	rr.write(ReplayDisconnect, tick, playerId)
+}
+
+func (rr *ReplayRecorder) RecordReconnect(tick uint32, playerId int32) {
+	rr.write(ReplayReconnect, tick, playerId)
+}
+
+// Round trip times are not simulated, so playback shows the recorded ones
+func (rr *ReplayRecorder) RecordLatency(tick uint32, playerId int32, rtt time.Duration, jitter time.Duration) {
+	rr.write(ReplayLatency, tick, struct {
+		PlayerId int32
+		Rtt      int64
+		Jitter   int64
+	}{playerId, int64(rtt), int64(jitter)})
+}
+
+func (rr *ReplayRecorder) RecordKeyframe(tick uint32, state []byte) {
+	rr.write(ReplayKeyframe, tick, uint32(len(state)))
+	if rr != nil {
+		rr.Writer.Write(state)
+	}
+}
+
+func (rr *ReplayRecorder) Close() error {
+	if rr == nil {
+		return nil
+	}
+
+	if !rr.Played {
+		rr.File.Close()
+		return os.Remove(rr.File.Name())
+	}
+
+	if err := rr.Writer.Flush(); err != nil {
+		rr.File.Close()
+		return err
+	}
+
+	return rr.File.Close()
+}
+
+func LoadReplay(path string) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replay := &Replay{
+		Events:    make([]ReplayEvent, 0),
+		Keyframes: make(map[uint32][]byte),
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &replay.Header); err != nil {
+		return nil, err
+	}
+
+	if string(replay.Header.Magic[:]) != REPLAY_MAGIC {
+		return nil, errors.New("not a replay file")
+	}
+
+	if replay.Header.Version != REPLAY_VERSION {
+		return nil, fmt.Errorf("unsupported replay version %d", replay.Header.Version)
+	}
+
+	var rulesLength uint32
+	if err := binary.Read(reader, binary.LittleEndian, &rulesLength); err != nil {
+		return nil, err
+	}
+
+	rules := make([]byte, rulesLength)
+	if _, err := io.ReadFull(reader, rules); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(rules, &replay.Rules); err != nil {
+		return nil, err
+	}
+
+	for {
+		var event ReplayEvent
+		if err := binary.Read(reader, binary.LittleEndian, &event.Type); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if err := binary.Read(reader, binary.LittleEndian, &event.Tick); err != nil {
+			return nil, err
+		}
+
+		switch event.Type {
+		case ReplayJoin:
+			var join struct {
+				PlayerId int32
+				IsBot    byte
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &join); err != nil {
+				return nil, err
+			}
+			event.PlayerId = join.PlayerId
+			event.IsBot = join.IsBot == 1
+		case ReplayLeave, ReplayDisconnect, ReplayReconnect:
+			if err := binary.Read(reader, binary.LittleEndian, &event.PlayerId); err != nil {
+				return nil, err
+			}
+		case ReplayInput:
+			var input struct {
+				PlayerId    int32
+				UpPressed   byte
+				DownPressed byte
+				Tick        uint32
+				Sequence    uint32
+				AckTick     uint32
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &input); err != nil {
+				return nil, err
+			}
+			event.PlayerId = input.PlayerId
+			event.Input = InputState{
+				UpPressed:   input.UpPressed == 1,
+				DownPressed: input.DownPressed == 1,
+				Tick:        input.Tick,
+				Sequence:    input.Sequence,
+				AckTick:     input.AckTick,
+			}
+		case ReplayLatency:
+			var latency struct {
+				PlayerId int32
+				Rtt      int64
+				Jitter   int64
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &latency); err != nil {
+				return nil, err
+			}
+			event.PlayerId = latency.PlayerId
+			event.Rtt = time.Duration(latency.Rtt)
+			event.Jitter = time.Duration(latency.Jitter)
+		case ReplayKeyframe:
+			var length uint32
+			if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+				return nil, err
+			}
+			state := make([]byte, length)
+			if _, err := io.ReadFull(reader, state); err != nil {
+				return nil, err
+			}
+			replay.Keyframes[event.Tick] = state
+			continue
+		default:
+			return nil, fmt.Errorf("unknown replay event %d", event.Type)
+		}
+
+		replay.Events = append(replay.Events, event)
+	}
+
+	return replay, nil
+}
+
+// Re-simulates the recorded session and streams it to the connection in real time,
+// until the replay ends or stop is closed
+func PlayReplay(conn *websocket.Conn, replay *Replay, stop <-chan struct{}) error {
+	session := NewGameSession(int(replay.Header.SessionId), replay.Header.Seed, replay.Rules)
+	session.Clock = NewTickClock(time.Unix(0, replay.Header.ClockStart))
+
+	if err := conn.WriteJSON(NewWelcomeMessage(0, session)); err != nil {
+		return err
+	}
+
+	// Watch from the point of view of the first player that joined
+	var viewerId int32 = 0
+
+	apply := func(event ReplayEvent) {
+		switch event.Type {
+		case ReplayJoin:
+			if viewerId == 0 {
+				viewerId = event.PlayerId
+			}
+			session.HandleRegister(&Player{
+				Id:          event.PlayerId,
+				Controller:  &ReplayController{},
+				Session:     session,
+				InputStates: make([]InputState, 0),
+				Ready:       make(chan bool, 1),
+			})
+		case ReplayLeave:
+			if player, ok := session.Players[event.PlayerId]; ok {
+				session.HandleUnregister(player)
+			}
+		case ReplayDisconnect:
+			if player, ok := session.Players[event.PlayerId]; ok {
+				session.HoldSeat(player)
+			}
+		case ReplayReconnect:
+			if player, ok := session.Players[event.PlayerId]; ok {
+				session.RestoreSeat(player)
+			}
+		case ReplayLatency:
+			if player, ok := session.Players[event.PlayerId]; ok {
+				player.Rtt = event.Rtt
+				player.Jitter = event.Jitter
+			}
+		case ReplayInput:
+			session.AddPlayerInput(InputUpdate{
+				PlayerId:   event.PlayerId,
+				InputState: event.Input,
+			})
+		}
+	}
+
+	tick := time.NewTicker(SESSION_DELTA_TIME)
+	defer tick.Stop()
+
+	index := 0
+	for {
+		for index < len(replay.Events) && replay.Events[index].Tick == session.Tick {
+			apply(replay.Events[index])
+			index++
+		}
+
+		if index >= len(replay.Events) {
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-stop:
+			return ErrReplayStopped
+		}
+		session.Step()
+
+		if keyframe, ok := replay.Keyframes[session.Tick]; ok {
+			session.Snapshots.Store(session.Tick, append([]byte(nil), keyframe...))
+		}
+
+		// Playback does not read acknowledgements, every frame is a full snapshot
+		if err := conn.WriteMessage(websocket.BinaryMessage, session.Frame(viewerId, 0)); err != nil {
+			return err
+		}
+	}
+}
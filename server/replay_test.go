@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLatestReplay(t *testing.T) {
+	newTestServer(t)
+	if err := os.MkdirAll(REPLAY_DIR, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other sessions sharing the prefix and files that are not replays are left out
+	for _, name := range []string{"7-100.replay", "7-2000.replay", "7-300.replay", "77-9000.replay", "7-9000.tmp", "7-x.replay"} {
+		if err := os.WriteFile(filepath.Join(REPLAY_DIR, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if name, ok := LatestReplay(7); !ok || name != "7-2000" {
+		t.Fatalf("latest replay %q, expected 7-2000", name)
+	}
+	if name, ok := LatestReplay(8); ok {
+		t.Fatalf("found replay %q of a session without one", name)
+	}
+}
+
+// Viewers are told the server restarts once it drains, instead of watching until the process exits
+func TestReplayViewersLeaveOnDrain(t *testing.T) {
+	sessions, server := newTestServer(t)
+
+	var clients sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			if err := playTestClient(server, 4, 30); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	clients.Wait()
+
+	// The replay is saved once the session ended
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := LatestReplay(4); ok && len(sessions.Summaries()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no replay saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/replay?id=4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(HelloMessage{Type: "hello", Version: PROTOCOL_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	var welcome WelcomeMessage
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Drain <- 0
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Fatalf("read %v, expected the server to restart", err)
+			}
+			return
+		}
+	}
+}
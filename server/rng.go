@@ -0,0 +1,28 @@
+package main
+
+// Splitmix64 generator, its whole state is one value so the simulation can be saved and restored
+type Rng struct {
+	State uint64
+}
+
+func NewRng(seed int64) Rng {
+	return Rng{State: uint64(seed)}
+}
+
+func (r *Rng) Uint64() uint64 {
+	r.State += 0x9e3779b97f4a7c15
+	z := r.State
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Uniform in [0, 1)
+func (r *Rng) Float32() float32 {
+	return float32(r.Uint64()>>40) / (1 << 24)
+}
+
+// Uniform in [0, n), n must be positive
+func (r *Rng) Intn(n int) int {
+	return int(r.Uint64() % uint64(n))
+}
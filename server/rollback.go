@@ -0,0 +1,157 @@
+package main
+
+import (
+	"time"
+)
+
+// How far back a late input can move the simulation in rollback sessions, 250 ms
+const ROLLBACK_WINDOW = 15
+
+// Simulated state of a player paddle, its inputs are kept on the player for the whole window
+type PaddleSimState struct {
+	Y       float32
+	Height  float32
+	Effects []Effect
+	Shield  bool
+	Input   InputState
+}
+
+// Everything Advance reads or writes, players are stored by slot
+type SimState struct {
+	Tick         uint32
+	Rand         Rng
+	Scores       [2]int32
+	Balls        []Ball
+	NextBallId   uint32
+	SpawnTime    time.Duration
+	PowerUps     []PowerUp
+	PowerUpTime  time.Duration
+	Time         time.Duration
+	State        GameState
+	ShouldUpdate bool
+	PauseTicks   uint32
+	Events       FrameEvents
+	Paddles      [MAX_PLAYERS]PaddleSimState
+}
+
+// Saved states of the last ticks, indexed by tick. States from before Since are invalid,
+// rolling back across a pause or a player joining or leaving is not possible
+type RollbackHistory struct {
+	States [ROLLBACK_WINDOW + 1]SimState
+	Since  uint32
+}
+
+func (rh *RollbackHistory) Get(tick uint32) (*SimState, bool) {
+	state := rh.Slot(tick)
+	if tick < rh.Since || state.Tick != tick {
+		return nil, false
+	}
+
+	return state, true
+}
+
+func (rh *RollbackHistory) Slot(tick uint32) *SimState {
+	return &rh.States[tick%(ROLLBACK_WINDOW+1)]
+}
+
+func (rh *RollbackHistory) Invalidate(tick uint32) {
+	rh.Since = tick
+}
+
+// Copies the simulation into the state, reusing its slices
+func (gs *GameSession) SaveState(state *SimState) {
+	state.Tick = gs.Tick
+	state.Rand = gs.Rand
+	state.Scores = gs.Scores
+	state.Balls = append(state.Balls[:0], gs.Balls...)
+	state.NextBallId = gs.NextBallId
+	state.SpawnTime = gs.SpawnTime
+	state.PowerUps = append(state.PowerUps[:0], gs.PowerUps...)
+	state.PowerUpTime = gs.PowerUpTime
+	state.Time = gs.Time
+	state.State = gs.State
+	state.ShouldUpdate = gs.ShouldUpdate
+	state.PauseTicks = gs.PauseTicks
+	state.Events = gs.Events
+
+	for slot, player := range gs.Slots {
+		if player == nil {
+			continue
+		}
+
+		paddle := &state.Paddles[slot]
+		paddle.Y = player.Y
+		paddle.Height = player.Height
+		paddle.Effects = append(paddle.Effects[:0], player.Effects...)
+		paddle.Shield = player.Shield
+		paddle.Input = player.Input
+	}
+}
+
+func (gs *GameSession) RestoreState(state *SimState) {
+	gs.Clock.Advance(-time.Duration(gs.Tick-state.Tick) * SESSION_DELTA_TIME)
+
+	gs.Tick = state.Tick
+	gs.Rand = state.Rand
+	gs.Scores = state.Scores
+	gs.Balls = append(gs.Balls[:0], state.Balls...)
+	gs.NextBallId = state.NextBallId
+	gs.SpawnTime = state.SpawnTime
+	gs.PowerUps = append(gs.PowerUps[:0], state.PowerUps...)
+	gs.PowerUpTime = state.PowerUpTime
+	gs.Time = state.Time
+	gs.State = state.State
+	gs.ShouldUpdate = state.ShouldUpdate
+	gs.PauseTicks = state.PauseTicks
+	gs.Events = state.Events
+
+	for slot, player := range gs.Slots {
+		if player == nil {
+			continue
+		}
+
+		paddle := &state.Paddles[slot]
+		player.Y = paddle.Y
+		player.Height = paddle.Height
+		player.Effects = append(player.Effects[:0], paddle.Effects...)
+		player.Shield = paddle.Shield
+		player.Input = paddle.Input
+	}
+}
+
+// Checks if an input for a past tick can still be applied by rolling back
+func (gs *GameSession) CanRollback(tick uint32) bool {
+	if !gs.Rules.Rollback || tick == 0 || tick > gs.Tick {
+		return false
+	}
+
+	_, ok := gs.Rollbacks.Get(tick - 1)
+	return ok
+}
+
+// Rolls back to the oldest tick late inputs were added for, if the history still reaches it
+func (gs *GameSession) ApplyRollback() {
+	if gs.RollbackTo == 0 {
+		return
+	}
+
+	tick := gs.RollbackTo
+	gs.RollbackTo = 0
+	gs.Rollback(tick)
+}
+
+// Goes back to the state before the tick and simulates again up to the current tick,
+// with the inputs that arrived since then
+func (gs *GameSession) Rollback(tick uint32) {
+	target := gs.Tick
+
+	state, ok := gs.Rollbacks.Get(tick - 1)
+	if !ok {
+		return
+	}
+
+	gs.RestoreState(state)
+	for gs.Tick < target {
+		gs.Advance()
+	}
+}
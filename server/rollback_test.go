@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Steps the session until the ball is in play
+func startTestGame(t *testing.T, gs *GameSession) {
+	for gs.State != Running || !gs.ShouldUpdate {
+		gs.Step()
+		if gs.Tick > 1000 {
+			t.Fatalf("game did not start")
+		}
+	}
+}
+
+func TestLateInputsRollBackToOnTimeState(t *testing.T) {
+	// Short of the ball reaching a goal, rollback does not go across the pause after it
+	const ticks = 90
+	const late = ROLLBACK_WINDOW / 2
+
+	rules := RulePresets["classic"]
+	rules.Rollback = true
+
+	onTime, rolledBack := newTestSession(7, rules), newTestSession(7, rules)
+	startTestGame(t, onTime)
+	startTestGame(t, rolledBack)
+
+	pending := make([]InputUpdate, 0)
+	sequences := make(map[int32]uint32)
+	for tick := 0; tick < ticks+late; tick++ {
+		// The second player's inputs reach the rolled back session late, the first player's on time
+		for _, player := range onTime.Slots {
+			if player == nil || tick >= ticks {
+				continue
+			}
+
+			input, ok := testInput(player.Id, onTime.Tick, sequences[player.Id]+1)
+			if !ok {
+				continue
+			}
+			sequences[player.Id]++
+
+			onTime.AddPlayerInput(input)
+			if player.Id == 2 {
+				pending = append(pending, input)
+			} else {
+				rolledBack.AddPlayerInput(input)
+			}
+		}
+
+		for len(pending) > 0 && pending[0].InputState.Tick+late <= rolledBack.Tick {
+			if !rolledBack.CanRollback(pending[0].InputState.Tick) {
+				t.Fatalf("can not roll back to tick %d at tick %d", pending[0].InputState.Tick, rolledBack.Tick)
+			}
+
+			rolledBack.AddPlayerInput(pending[0])
+			pending = pending[1:]
+		}
+
+		onTime.Step()
+		rolledBack.Step()
+	}
+
+	if len(pending) > 0 {
+		t.Fatalf("%d inputs never arrived", len(pending))
+	}
+
+	var expected, actual SimState
+	onTime.SaveState(&expected)
+	rolledBack.SaveState(&actual)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("rolled back state differs:\n%+v\n%+v", expected, actual)
+	}
+
+	expectedSnapshot, _ := onTime.Snapshots.Get(onTime.Tick)
+	actualSnapshot, _ := rolledBack.Snapshots.Get(rolledBack.Tick)
+	if !bytes.Equal(expectedSnapshot, actualSnapshot) {
+		t.Fatalf("rolled back snapshot differs")
+	}
+
+	if sequences[2] == 0 || rolledBack.Players[2].Input.Sequence != onTime.Players[2].Input.Sequence {
+		t.Fatalf("acknowledged sequence %d, expected %d", rolledBack.Players[2].Input.Sequence, onTime.Players[2].Input.Sequence)
+	}
+}
+
+func TestNewerInputNeverAppliesBeforeOlder(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		rules := RulePresets["classic"]
+		rules.Rollback = rollback
+
+		gs := newTestSession(1, rules)
+		startTestGame(t, gs)
+
+		// The newer input asks for an earlier tick than the older one
+		tick := gs.Tick
+		gs.AddPlayerInput(InputUpdate{PlayerId: 1, InputState: InputState{DownPressed: true, Sequence: 1, Tick: tick + 20}})
+		gs.AddPlayerInput(InputUpdate{PlayerId: 1, InputState: InputState{UpPressed: true, Sequence: 2, Tick: tick + 5}})
+
+		var acknowledged uint32 = 0
+		for gs.Tick < tick+25 {
+			gs.Step()
+
+			sequence := gs.Players[1].Input.Sequence
+			if sequence < acknowledged {
+				t.Fatalf("rollback %t: acknowledged sequence went from %d back to %d", rollback, acknowledged, sequence)
+			}
+			acknowledged = sequence
+		}
+
+		if input := gs.Players[1].Input; input.Sequence != 2 || !input.UpPressed {
+			t.Fatalf("rollback %t: applied input %+v, expected the newer one", rollback, input)
+		}
+	}
+}
+
+func TestLateInputsRollBackOncePerTick(t *testing.T) {
+	rules := RulePresets["classic"]
+	rules.Rollback = true
+
+	gs := newTestSession(5, rules)
+	startTestGame(t, gs)
+	for i := 0; i < ROLLBACK_WINDOW; i++ {
+		gs.Step()
+	}
+
+	// Every player sends inputs for ticks the session already simulated, the oldest one is rolled back to
+	tick := gs.Tick
+	gs.AddPlayerInput(InputUpdate{PlayerId: 1, InputState: InputState{UpPressed: true, Sequence: 1, Tick: tick - 2}})
+	gs.AddPlayerInput(InputUpdate{PlayerId: 2, InputState: InputState{UpPressed: true, Sequence: 1, Tick: tick - 5}})
+	gs.AddPlayerInput(InputUpdate{PlayerId: 1, InputState: InputState{DownPressed: true, Sequence: 2, Tick: tick - 1}})
+	if gs.RollbackTo != tick-5 {
+		t.Fatalf("rolling back to tick %d, expected %d", gs.RollbackTo, tick-5)
+	}
+	if gs.Tick != tick {
+		t.Fatalf("rolled back before the step")
+	}
+
+	gs.Step()
+	if gs.RollbackTo != 0 || gs.Tick != tick+1 {
+		t.Fatalf("at tick %d after the step, rollback to %d still pending", gs.Tick, gs.RollbackTo)
+	}
+	if input := gs.Players[1].Input; input.Sequence != 2 || !input.DownPressed {
+		t.Fatalf("applied input %+v, expected the latest late one", input)
+	}
+}
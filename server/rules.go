@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const DEFAULT_RULES = "classic"
+
+// Largest court side and fastest serve a rule set can ask for, courts leave room in the
+// snapshot encoding for balls that are leaving them
+const MAX_COURT_SIZE = 1600
+const MAX_BALL_SPEED = 2000
+
+// Everything that can be tuned per session, sent to the clients when they join
+type Rules struct {
+	Name               string  `json:"name"`
+	ScoreLimit         int32   `json:"scoreLimit"`
+	ScoreDifference    int32   `json:"scoreDifference"`
+	BallSpeed          float32 `json:"ballSpeed"`
+	BallSpeedRate      float32 `json:"ballSpeedRate"`
+	MaxBallSpeedFactor float32 `json:"maxBallSpeedFactor"`
+	PlayerSpeed        float32 `json:"playerSpeed"`
+	PlayerWidth        float32 `json:"playerWidth"`
+	PlayerHeight       float32 `json:"playerHeight"`
+	CourtWidth         float32 `json:"courtWidth"`
+	CourtHeight        float32 `json:"courtHeight"`
+	TeamSize           int32   `json:"teamSize"`
+	MaxBalls           int32   `json:"maxBalls"`
+	BallSpawnInterval  float32 `json:"ballSpawnInterval"` // Seconds between extra balls, zero to only spawn on smashes
+	SpawnOnSmash       bool    `json:"spawnOnSmash"`
+	PowerUps           bool    `json:"powerUps"`
+	PowerUpInterval    float32 `json:"powerUpInterval"` // Seconds between power-ups
+	Rollback           bool    `json:"rollback"`        // Simulate again from the tick of late inputs
+}
+
+var RulePresets = map[string]Rules{
+	"classic": {
+		Name:               "classic",
+		ScoreLimit:         GAME_SCORE_LIMIT,
+		ScoreDifference:    GAME_SCORE_DIFFERENCE,
+		BallSpeed:          BALL_SPEED,
+		BallSpeedRate:      BALL_SPEED_RATE,
+		MaxBallSpeedFactor: MAX_BALL_SPEED_FACTOR,
+		PlayerSpeed:        PLAYER_SPEED,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       PLAYER_HEIGHT,
+		CourtWidth:         COURT_WIDTH,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           1,
+		MaxBalls:           1,
+	},
+	// Short games with a fast ball that speeds up quickly
+	"blitz": {
+		Name:               "blitz",
+		ScoreLimit:         5,
+		ScoreDifference:    1,
+		BallSpeed:          300,
+		BallSpeedRate:      1.05,
+		MaxBallSpeedFactor: MAX_BALL_SPEED_FACTOR,
+		PlayerSpeed:        150,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       80,
+		CourtWidth:         COURT_WIDTH,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           1,
+		MaxBalls:           1,
+	},
+	// Long games with long rallies
+	"marathon": {
+		Name:               "marathon",
+		ScoreLimit:         21,
+		ScoreDifference:    2,
+		BallSpeed:          150,
+		BallSpeedRate:      1.01,
+		MaxBallSpeedFactor: 5,
+		PlayerSpeed:        PLAYER_SPEED,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       120,
+		CourtWidth:         1000,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           1,
+		MaxBalls:           1,
+	},
+	// Two against two, with a front and a back paddle per side
+	"doubles": {
+		Name:               "doubles",
+		ScoreLimit:         GAME_SCORE_LIMIT,
+		ScoreDifference:    GAME_SCORE_DIFFERENCE,
+		BallSpeed:          BALL_SPEED,
+		BallSpeedRate:      BALL_SPEED_RATE,
+		MaxBallSpeedFactor: MAX_BALL_SPEED_FACTOR,
+		PlayerSpeed:        PLAYER_SPEED,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       PLAYER_HEIGHT,
+		CourtWidth:         1000,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           2,
+		MaxBalls:           1,
+	},
+	// Extra balls every few seconds and on every smash
+	"multiball": {
+		Name:               "multiball",
+		ScoreLimit:         GAME_SCORE_LIMIT,
+		ScoreDifference:    GAME_SCORE_DIFFERENCE,
+		BallSpeed:          BALL_SPEED,
+		BallSpeedRate:      BALL_SPEED_RATE,
+		MaxBallSpeedFactor: MAX_BALL_SPEED_FACTOR,
+		PlayerSpeed:        PLAYER_SPEED,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       PLAYER_HEIGHT,
+		CourtWidth:         COURT_WIDTH,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           1,
+		MaxBalls:           4,
+		BallSpawnInterval:  8,
+		SpawnOnSmash:       true,
+	},
+	// Classic with power-ups spawning in the middle of the court
+	"powerups": {
+		Name:               "powerups",
+		ScoreLimit:         GAME_SCORE_LIMIT,
+		ScoreDifference:    GAME_SCORE_DIFFERENCE,
+		BallSpeed:          BALL_SPEED,
+		BallSpeedRate:      BALL_SPEED_RATE,
+		MaxBallSpeedFactor: MAX_BALL_SPEED_FACTOR,
+		PlayerSpeed:        PLAYER_SPEED,
+		PlayerWidth:        PLAYER_WIDTH,
+		PlayerHeight:       PLAYER_HEIGHT,
+		CourtWidth:         COURT_WIDTH,
+		CourtHeight:        COURT_HEIGHT,
+		TeamSize:           1,
+		MaxBalls:           1,
+		PowerUps:           true,
+		PowerUpInterval:    6,
+	},
+}
+
+func (rules *Rules) MaxPlayers() int {
+	return 2 * int(rules.TeamSize)
+}
+
+var ErrUnknownRules = errors.New("unknown rule set")
+
+func (rules *Rules) Validate() error {
+	// NaN and infinities pass every comparison below and can not be sent to the clients
+	for _, value := range []float32{
+		rules.BallSpeed, rules.BallSpeedRate, rules.MaxBallSpeedFactor,
+		rules.PlayerSpeed, rules.PlayerWidth, rules.PlayerHeight,
+		rules.CourtWidth, rules.CourtHeight, rules.BallSpawnInterval, rules.PowerUpInterval,
+	} {
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return errors.New("rule values must be finite numbers")
+		}
+	}
+
+	if rules.ScoreLimit < 1 || rules.ScoreDifference < 1 {
+		return errors.New("score limit and difference must be positive")
+	}
+
+	if rules.BallSpeed <= 0 || rules.BallSpeedRate < 1 || rules.MaxBallSpeedFactor < 1 {
+		return errors.New("ball speed must be positive and can not ramp down")
+	}
+
+	if rules.BallSpeed > MAX_BALL_SPEED {
+		return fmt.Errorf("ball speed can be at most %d", MAX_BALL_SPEED)
+	}
+
+	// Smashes speed the ball up to the top speed, which snapshots have to be able to carry
+	if rules.BallSpeed*rules.MaxBallSpeedFactor > MAX_SNAPSHOT_VELOCITY {
+		return fmt.Errorf("top ball speed can be at most %d", MAX_SNAPSHOT_VELOCITY)
+	}
+
+	if rules.CourtWidth < 4*BALL_RADIUS || rules.CourtHeight < 4*BALL_RADIUS {
+		return errors.New("court is too small")
+	}
+
+	if rules.CourtWidth > MAX_COURT_SIZE || rules.CourtHeight > MAX_COURT_SIZE {
+		return fmt.Errorf("court sides can be at most %d", MAX_COURT_SIZE)
+	}
+
+	if rules.PlayerSpeed <= 0 || rules.PlayerWidth <= 0 || rules.PlayerHeight <= 0 {
+		return errors.New("paddle size and speed must be positive")
+	}
+
+	if rules.PlayerWidth*4 > rules.CourtWidth || rules.PlayerHeight > rules.CourtHeight {
+		return errors.New("paddle does not fit the court")
+	}
+
+	if rules.TeamSize < 1 || rules.TeamSize > MAX_TEAM_SIZE {
+		return fmt.Errorf("team size must be between 1 and %d", MAX_TEAM_SIZE)
+	}
+
+	if rules.MaxBalls < 1 || rules.MaxBalls > MAX_BALLS {
+		return fmt.Errorf("ball count must be between 1 and %d", MAX_BALLS)
+	}
+
+	if rules.BallSpawnInterval < 0 {
+		return errors.New("ball spawn interval must not be negative")
+	}
+
+	if rules.PowerUps && rules.PowerUpInterval <= 0 {
+		return errors.New("power-up interval must be positive")
+	}
+
+	return nil
+}
+
+// Starts from the preset in ?rules=, then applies a JSON body and single field overrides from the query
+func ParseRules(r *http.Request) (Rules, error) {
+	query := r.URL.Query()
+
+	name := query.Get("rules")
+	if name == "" {
+		name = DEFAULT_RULES
+	}
+
+	rules, ok := RulePresets[name]
+	if !ok {
+		return Rules{}, ErrUnknownRules
+	}
+
+	// Requests without a body only use the query, a body has to be the rules as JSON
+	if r.Body != nil && r.ContentLength != 0 {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			return Rules{}, errors.New("rules body must be application/json")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			return Rules{}, fmt.Errorf("invalid rules body: %w", err)
+		}
+	}
+
+	ints := map[string]*int32{
+		"scoreLimit":      &rules.ScoreLimit,
+		"scoreDifference": &rules.ScoreDifference,
+		"teamSize":        &rules.TeamSize,
+		"maxBalls":        &rules.MaxBalls,
+	}
+	for key, field := range ints {
+		if !query.Has(key) {
+			continue
+		}
+
+		value, err := strconv.ParseInt(query.Get(key), 10, 32)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*field = int32(value)
+	}
+
+	floats := map[string]*float32{
+		"ballSpeed":          &rules.BallSpeed,
+		"ballSpeedRate":      &rules.BallSpeedRate,
+		"maxBallSpeedFactor": &rules.MaxBallSpeedFactor,
+		"playerSpeed":        &rules.PlayerSpeed,
+		"playerWidth":        &rules.PlayerWidth,
+		"playerHeight":       &rules.PlayerHeight,
+		"courtWidth":         &rules.CourtWidth,
+		"courtHeight":        &rules.CourtHeight,
+		"ballSpawnInterval":  &rules.BallSpawnInterval,
+		"powerUpInterval":    &rules.PowerUpInterval,
+	}
+	for key, field := range floats {
+		if !query.Has(key) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(query.Get(key), 32)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*field = float32(value)
+	}
+
+	bools := map[string]*bool{
+		"spawnOnSmash": &rules.SpawnOnSmash,
+		"powerUps":     &rules.PowerUps,
+		"rollback":     &rules.Rollback,
+	}
+	for key, field := range bools {
+		if !query.Has(key) {
+			continue
+		}
+
+		value, err := strconv.ParseBool(query.Get(key))
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*field = value
+	}
+
+	if err := rules.Validate(); err != nil {
+		return Rules{}, err
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRulesBody(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		ok          bool
+	}{
+		{"no body", "", "", true},
+		{"json", "application/json", `{"scoreLimit": 5}`, true},
+		{"json with charset", "application/json; charset=utf-8", `{"scoreLimit": 5}`, true},
+		{"json in capitals", "Application/JSON", `{"scoreLimit": 5}`, true},
+		{"wrong type", "text/plain", `{"scoreLimit": 5}`, false},
+		{"missing type", "", `{"scoreLimit": 5}`, false},
+		{"broken json", "application/json", `{"scoreLimit":`, false},
+		{"negative spawn interval", "application/json", `{"ballSpawnInterval": -1}`, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/sessions?rules=classic", strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+
+		rules, err := ParseRules(r)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: got %v", c.name, err)
+		}
+		if c.ok && c.body != "" && rules.ScoreLimit != 5 {
+			t.Fatalf("%s: score limit %d from the body", c.name, rules.ScoreLimit)
+		}
+	}
+}
+
+func TestNegativeSpawnIntervalError(t *testing.T) {
+	rules := RulePresets["multiball"]
+	rules.BallSpawnInterval = -1
+	if err := rules.Validate(); err == nil || strings.Contains(err.Error(), "ball count") {
+		t.Fatalf("negative spawn interval gives %v", err)
+	}
+}
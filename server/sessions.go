@@ -1,34 +1,270 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand"
+	"time"
+)
 
+// How long running games get to finish on shutdown before they are stopped
+const DEFAULT_DRAIN_TIMEOUT = 60 * time.Second
+
+type CreateRequest struct {
+	Rules   Rules
+	Created chan *GameSession
+}
+
+// Finds the session with the id, and starts it with the rules if there is none and rules are given
+type FindRequest struct {
+	Id     int
+	Rules  *Rules
+	Result chan FindResult
+}
+
+type FindResult struct {
+	Session *GameSession // Nil if there is no session with the id
+	Created bool
+}
+
+type ListRequest struct {
+	Result chan []*GameSession
+}
+
+// What the session list shows, taken by the session goroutine
+type SessionSummary struct {
+	Id            int             `json:"id"`
+	NumPlayers    int             `json:"numPlayers"`
+	MaxPlayers    int             `json:"maxPlayers"`
+	NumSpectators int             `json:"numSpectators"`
+	Players       []PlayerSummary `json:"players"`
+	Replay        string          `json:"replay,omitempty"` // Name to stream the replay with once the session ended
+	TickDurations *Histogram      `json:"-"`
+}
+
+type PlayerSummary struct {
+	Id     int32 `json:"id"`
+	Side   uint8 `json:"side"`
+	Rtt    int64 `json:"rtt"` // Milliseconds
+	Jitter int64 `json:"jitter"`
+	Bot    bool  `json:"bot"`
+
+	// Seat held for a reconnect
+	Disconnected bool `json:"disconnected"`
+}
+
+// The map is only touched by Run, other goroutines go through the request channels
 type Sessions struct {
 	Sessions      map[int]*GameSession
-	Register      chan *GameSession
 	Unregister    chan *GameSession
 	RegisterInput chan InputUpdate
+	Matchmaker    *Matchmaker
+	Profiles      *Profiles
+	Enqueue       chan *QueueTicket
+	Dequeue       chan *QueueTicket
+	CreateSession chan CreateRequest
+	Logger        *slog.Logger
+	FindSession   chan FindRequest
+	ListSessions  chan ListRequest
+	ImportSession chan ImportRequest
+
+	// Drain starts the shutdown, no sessions are started after Draining is closed.
+	// Sessions stop right away once Stopping is closed, and Stopped is closed when Run returns
+	Drain    chan time.Duration
+	Draining chan struct{}
+	Stopping chan struct{}
+	Stopped  chan struct{}
 }
 
-func NewSessions() *Sessions {
+func NewSessions(botTimeout time.Duration, profiles *Profiles) *Sessions {
 	return &Sessions{
 		Sessions:      make(map[int]*GameSession),
-		Register:      make(chan *GameSession),
 		Unregister:    make(chan *GameSession),
 		RegisterInput: make(chan InputUpdate),
+		Matchmaker:    NewMatchmaker(botTimeout),
+		Profiles:      profiles,
+		Enqueue:       make(chan *QueueTicket),
+		Dequeue:       make(chan *QueueTicket),
+		CreateSession: make(chan CreateRequest),
+		Logger:        slog.Default(),
+		FindSession:   make(chan FindRequest),
+		ListSessions:  make(chan ListRequest),
+		ImportSession: make(chan ImportRequest),
+		Drain:         make(chan time.Duration),
+		Draining:      make(chan struct{}),
+		Stopping:      make(chan struct{}),
+		Stopped:       make(chan struct{}),
+	}
+}
+
+func (sessions *Sessions) Add(session *GameSession) {
+	sessions.Sessions[session.Id] = session
+	session.Sessions = sessions
+	sessions.Logger.Info("Registered session", "session", session.Id)
+	go session.Run()
+}
+
+// Starts a session under an unused id, only call from Run
+func (sessions *Sessions) Create(rules Rules) *GameSession {
+	id := mathrand.Intn(1 << 31)
+	for _, ok := sessions.Sessions[id]; ok; _, ok = sessions.Sessions[id] {
+		id = mathrand.Intn(1 << 31)
+	}
+
+	session := NewGameSession(id, time.Now().UnixNano(), rules)
+	sessions.Add(session)
+	return session
+}
+
+// Looks up a session from any goroutine, and starts one under the id if rules are given
+func (sessions *Sessions) Find(id int, rules *Rules) FindResult {
+	request := FindRequest{Id: id, Rules: rules, Result: make(chan FindResult, 1)}
+	select {
+	case sessions.FindSession <- request:
+		return <-request.Result
+	case <-sessions.Stopped:
+		return FindResult{}
 	}
 }
 
+// Starts a session under an unused id, returns nil once the server is shutting down
+func (sessions *Sessions) RequestCreate(rules Rules) *GameSession {
+	request := CreateRequest{Rules: rules, Created: make(chan *GameSession, 1)}
+	select {
+	case sessions.CreateSession <- request:
+		return <-request.Created
+	case <-sessions.Stopped:
+		return nil
+	}
+}
+
+// Summaries of the running sessions, sessions that end while asked are left out
+func (sessions *Sessions) Summaries() []SessionSummary {
+	summaries := make([]SessionSummary, 0)
+
+	request := ListRequest{Result: make(chan []*GameSession, 1)}
+	select {
+	case sessions.ListSessions <- request:
+	case <-sessions.Stopped:
+		return summaries
+	}
+
+	for _, session := range <-request.Result {
+		result := make(chan SessionSummary, 1)
+		select {
+		case session.Summarize <- result:
+			summaries = append(summaries, <-result)
+		case <-session.Done:
+		}
+	}
+
+	return summaries
+}
+
+// Only call from the session goroutine
+func (gs *GameSession) Summary() SessionSummary {
+	summary := SessionSummary{
+		Id:            gs.Id,
+		NumPlayers:    len(gs.Players),
+		MaxPlayers:    gs.Rules.MaxPlayers(),
+		NumSpectators: len(gs.Spectators),
+		Players:       make([]PlayerSummary, 0, len(gs.Players)),
+		TickDurations: gs.TickDurations,
+	}
+
+	if gs.Recorder != nil {
+		summary.Replay = gs.Recorder.Name
+	}
+
+	for _, player := range gs.Slots {
+		if player != nil {
+			_, isBot := player.Controller.(*BotController)
+			summary.Players = append(summary.Players, PlayerSummary{
+				Id:           player.Id,
+				Side:         player.Team,
+				Rtt:          player.Rtt.Milliseconds(),
+				Jitter:       player.Jitter.Milliseconds(),
+				Bot:          isBot,
+				Disconnected: player.Disconnected,
+			})
+		}
+	}
+
+	return summary
+}
+
 func (sessions *Sessions) Run() {
+	matchTick := time.NewTicker(MATCHMAKER_INTERVAL)
+	defer matchTick.Stop()
+	defer close(sessions.Stopped)
+
+	draining := false
+	var deadline <-chan time.Time
+
 	for {
 		select {
-		case session := <-sessions.Register:
-			sessions.Sessions[session.Id] = session
-			session.Sessions = sessions
-			fmt.Println("Registered session", session.Id)
-			go session.Run()
 		case session := <-sessions.Unregister:
-			delete(sessions.Sessions, session.Id)
-			fmt.Println("Unregistered session", session.Id)
+			if sessions.Sessions[session.Id] == session {
+				delete(sessions.Sessions, session.Id)
+			}
+			sessions.Logger.Info("Unregistered session", "session", session.Id)
+
+			if draining && len(sessions.Sessions) == 0 {
+				sessions.Logger.Info("All sessions stopped")
+				return
+			}
+		case ticket := <-sessions.Enqueue:
+			sessions.Matchmaker.Add(ticket)
+			if !draining {
+				sessions.Matchmaker.Match(sessions)
+			}
+		case ticket := <-sessions.Dequeue:
+			sessions.Matchmaker.Remove(ticket)
+		case request := <-sessions.CreateSession:
+			if draining {
+				request.Created <- nil
+				continue
+			}
+			request.Created <- sessions.Create(request.Rules)
+		case request := <-sessions.FindSession:
+			session, created := sessions.Sessions[request.Id], false
+			if session == nil && request.Rules != nil && !draining {
+				session, created = NewGameSession(request.Id, time.Now().UnixNano(), *request.Rules), true
+				sessions.Add(session)
+			}
+			request.Result <- FindResult{Session: session, Created: created}
+		case request := <-sessions.ImportSession:
+			if draining {
+				request.Result <- errors.New("server is shutting down")
+			} else if _, ok := sessions.Sessions[request.Session.Id]; ok {
+				request.Result <- fmt.Errorf("session %d already exists", request.Session.Id)
+			} else {
+				sessions.Add(request.Session)
+				request.Result <- nil
+			}
+		case request := <-sessions.ListSessions:
+			list := make([]*GameSession, 0, len(sessions.Sessions))
+			for _, session := range sessions.Sessions {
+				list = append(list, session)
+			}
+			request.Result <- list
+		case <-matchTick.C:
+			if !draining {
+				sessions.Matchmaker.Match(sessions)
+			}
+		case timeout := <-sessions.Drain:
+			sessions.Logger.Info("Draining sessions", "sessions", len(sessions.Sessions), "timeout", timeout)
+			draining = true
+			close(sessions.Draining)
+			deadline = time.After(timeout)
+
+			if len(sessions.Sessions) == 0 {
+				return
+			}
+		case <-deadline:
+			sessions.Logger.Warn("Stopping sessions that did not finish", "sessions", len(sessions.Sessions))
+			close(sessions.Stopping)
 		}
 	}
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Registry and server like main starts them, replays and profiles go to a temporary directory
+func newTestServer(t *testing.T) (*Sessions, *httptest.Server) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	profiles, err := LoadProfiles(filepath.Join(dir, PROFILES_PATH))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := NewSessions(DEFAULT_QUEUE_BOT_TIMEOUT, profiles)
+	go sessions.Run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		handleSessions(sessions, w, r)
+	})
+	mux.HandleFunc("/play", func(w http.ResponseWriter, r *http.Request) {
+		handlePlay(sessions, w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(sessions, w, r)
+	})
+	mux.HandleFunc("/replay", func(w http.ResponseWriter, r *http.Request) {
+		handleReplay(sessions, w, r)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		select {
+		case sessions.Drain <- 0:
+		case <-sessions.Stopped:
+		}
+		<-sessions.Stopped
+	})
+
+	return sessions, server
+}
+
+// Says hello and plays for the number of frames, sending an input every few frames
+func playTestClient(server *httptest.Server, id int, frames int) error {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + fmt.Sprintf("/play?id=%d", id)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(HelloMessage{Type: "hello", Version: PROTOCOL_VERSION}); err != nil {
+		return err
+	}
+
+	var welcome WelcomeMessage
+	if err := conn.ReadJSON(&welcome); err != nil {
+		return err
+	}
+	if welcome.PlayerId == 0 {
+		return fmt.Errorf("welcome without a player id")
+	}
+
+	var sequence uint32 = 0
+	for frame := 0; frame < frames; frame++ {
+		mt, p, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if mt != websocket.BinaryMessage || len(p) < 14 {
+			continue
+		}
+		tick := binary.LittleEndian.Uint32(p[10:])
+
+		message := binary.LittleEndian.AppendUint32(nil, tick)
+		if frame%4 == 0 {
+			sequence++
+			message = []byte{byte(frame / 4 % 2), byte(1 - frame/4%2)}
+			message = binary.LittleEndian.AppendUint32(message, sequence)
+			message = binary.LittleEndian.AppendUint32(message, tick+2)
+			message = binary.LittleEndian.AppendUint32(message, tick)
+		}
+
+		if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			return err
+		}
+	}
+
+	// Waits for the close frame of the server, like browsers do, or the player would be dropped instead of leaving
+	if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return nil
+		}
+	}
+}
+
+// Meant to be run with -race: players join, play and leave while the sessions are listed and created
+func TestSessionsUnderLoad(t *testing.T) {
+	const numSessions = 20
+	const frames = 30
+
+	sessions, server := newTestServer(t)
+
+	var clients sync.WaitGroup
+	errs := make(chan error, 2*numSessions)
+	for i := 0; i < 2*numSessions; i++ {
+		clients.Add(1)
+		go func(id int) {
+			defer clients.Done()
+			if err := playTestClient(server, id, frames); err != nil {
+				errs <- fmt.Errorf("session %d: %w", id, err)
+			}
+		}(1 + i/2)
+	}
+
+	done := make(chan struct{})
+	var listers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		listers.Add(1)
+		go func(i int) {
+			defer listers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				switch i {
+				case 0:
+					sessions.Summaries()
+				case 1:
+					response, err := http.Get(server.URL + "/sessions")
+					if err != nil {
+						errs <- err
+						return
+					}
+					var summaries []SessionSummary
+					if err := json.NewDecoder(response.Body).Decode(&summaries); err != nil {
+						errs <- err
+					}
+					response.Body.Close()
+				case 2:
+					if session := sessions.RequestCreate(RulePresets["classic"]); session == nil {
+						errs <- fmt.Errorf("could not create a session")
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				case 3:
+					sessions.Find(1+i%numSessions, nil)
+				}
+			}
+		}(i)
+	}
+
+	clients.Wait()
+	close(done)
+	listers.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Every played session ends once both of its players left
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		played := 0
+		for _, summary := range sessions.Summaries() {
+			if summary.Id >= 1 && summary.Id <= numSessions {
+				played++
+			}
+		}
+
+		if played == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still running after their players left", played)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Joining a session that ended or a server that stops tells the client why instead of hanging
+func TestRegisterPlayerAfterSessionEnded(t *testing.T) {
+	moved := websocket.FormatCloseMessage(CLOSE_SESSION_MOVED, "ws://other.example/play?id=1")
+
+	cases := map[string]struct {
+		ended    bool
+		stopping bool
+		code     int
+	}{
+		"session ended":   {ended: true, code: CLOSE_SESSION_MOVED},
+		"server stopping": {stopping: true, code: websocket.CloseServiceRestart},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			// Not running, with its registration queue already full
+			session := NewGameSession(1, 1, RulePresets["classic"])
+			session.RegisterPlayer <- &Player{}
+			if c.ended {
+				session.CloseMessage = moved
+				close(session.Done)
+			}
+
+			sessions := &Sessions{Stopping: make(chan struct{})}
+			if c.stopping {
+				close(sessions.Stopping)
+			}
+
+			registered := make(chan bool, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				registered <- registerPlayer(conn, sessions, session, &Player{})
+			}))
+			defer server.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, c.code) {
+				t.Fatalf("read %v, expected close %d", err, c.code)
+			}
+
+			select {
+			case ok := <-registered:
+				if ok {
+					t.Fatalf("registered with a session that can not take the player")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("registration still waiting")
+			}
+		})
+	}
+}
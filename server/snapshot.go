@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Version of the state frame layout, sent first in every frame
+const PROTOCOL_VERSION = 7
+
+// About a second of snapshots clients can acknowledge and get deltas against
+const SNAPSHOT_HISTORY = 64
+
+// Positions in 1/16 px and velocities in 1/4 px/s, stored as int16 and saturating beyond
+// these bounds. Rules keep courts and top speeds within them, balls leaving the court can still saturate
+const POSITION_SCALE = 16
+const VELOCITY_SCALE = 4
+const MAX_SNAPSHOT_POSITION = math.MaxInt16 / POSITION_SCALE
+const MAX_SNAPSHOT_VELOCITY = math.MaxInt16 / VELOCITY_SCALE
+
+const (
+	FrameFull uint8 = iota
+	FrameDelta
+)
+
+// Encoded snapshots of the last ticks, indexed by tick
+type SnapshotHistory struct {
+	Ticks     [SNAPSHOT_HISTORY]uint32
+	Snapshots [SNAPSHOT_HISTORY][]byte
+}
+
+func (sh *SnapshotHistory) Get(tick uint32) ([]byte, bool) {
+	index := tick % SNAPSHOT_HISTORY
+	if tick == 0 || sh.Ticks[index] != tick {
+		return nil, false
+	}
+
+	return sh.Snapshots[index], true
+}
+
+// Buffer to encode the snapshot of a tick into, reusing the slot it replaces
+func (sh *SnapshotHistory) Slot(tick uint32) []byte {
+	return sh.Snapshots[tick%SNAPSHOT_HISTORY][:0]
+}
+
+func (sh *SnapshotHistory) Store(tick uint32, snapshot []byte) {
+	index := tick % SNAPSHOT_HISTORY
+	sh.Ticks[index] = tick
+	sh.Snapshots[index] = snapshot
+}
+
+func quantize(v float32, scale float32) int16 {
+	return int16(Clamp(float32(math.Round(float64(v*scale))), math.MinInt16, math.MaxInt16))
+}
+
+func appendPosition(buf []byte, v float32) []byte {
+	return binary.LittleEndian.AppendUint16(buf, uint16(quantize(v, POSITION_SCALE)))
+}
+
+func appendVelocity(buf []byte, v float32) []byte {
+	return binary.LittleEndian.AppendUint16(buf, uint16(quantize(v, VELOCITY_SCALE)))
+}
+
+func (events *FrameEvents) Flags() uint8 {
+	flags := []bool{
+		events.BallCollided,
+		events.BallHitPlayer,
+		events.BallWasSmashed,
+		events.NewRound,
+		events.BallSpawned,
+		events.PowerUpSpawned,
+		events.PowerUpCollected,
+		events.ShieldUsed,
+	}
+
+	var bits uint8 = 0
+	for i, flag := range flags {
+		if flag {
+			bits |= 1 << i
+		}
+	}
+
+	return bits
+}
+
+// Quantized state of the session, players in slot order so unchanged state encodes to the same bytes
+func (gs *GameSession) EncodeSnapshot(buf []byte) []byte {
+	buf = append(buf, uint8(gs.State), gs.Events.Flags())
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(gs.Scores[0]))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(gs.Scores[1]))
+	buf = append(buf, uint8(len(gs.Players)), uint8(len(gs.Balls)), uint8(len(gs.PowerUps)))
+
+	for slot, player := range gs.Slots {
+		if player == nil {
+			continue
+		}
+
+		buf = append(buf, uint8(slot), player.Team)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(player.Id))
+		buf = appendPosition(buf, player.X)
+		buf = appendPosition(buf, player.Y)
+		buf = appendPosition(buf, player.Height)
+		buf = append(buf, player.EffectFlags(), player.Input.Flags())
+		buf = binary.LittleEndian.AppendUint32(buf, player.Input.Sequence)
+		buf = binary.LittleEndian.AppendUint16(buf, player.RttMillis())
+	}
+
+	for _, ball := range gs.Balls {
+		buf = appendPosition(buf, ball.X)
+		buf = appendPosition(buf, ball.Y)
+		buf = appendVelocity(buf, ball.VelocityX)
+		buf = appendVelocity(buf, ball.VelocityY)
+	}
+
+	for _, powerUp := range gs.PowerUps {
+		buf = append(buf, uint8(powerUp.Type))
+		buf = appendPosition(buf, powerUp.X)
+		buf = appendPosition(buf, powerUp.Y)
+	}
+
+	return buf
+}
+
+// XOR of the snapshot against a base of the same length, written as runs of
+// unchanged byte count, changed byte count and the changed bytes
+func EncodeDelta(buf []byte, base []byte, snapshot []byte) []byte {
+	i := 0
+	for i < len(snapshot) {
+		start := i
+		for i < len(snapshot) && snapshot[i] == base[i] {
+			i++
+		}
+		unchanged := i - start
+
+		start = i
+		for i < len(snapshot) && snapshot[i] != base[i] {
+			i++
+		}
+
+		if i == start {
+			break
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(unchanged))
+		buf = binary.AppendUvarint(buf, uint64(i-start))
+		for j := start; j < i; j++ {
+			buf = append(buf, snapshot[j]^base[j])
+		}
+	}
+
+	return buf
+}
+
+// Frame sent to a client: version, kind, the receiving player id, the sequence of its last input
+// applied and the tick, followed by the full snapshot or the base tick and a delta against it
+func (gs *GameSession) Frame(playerId int32, ackTick uint32) []byte {
+	snapshot, _ := gs.Snapshots.Get(gs.Tick)
+	base, ok := gs.Snapshots.Get(ackTick)
+	delta := ok && ackTick != gs.Tick && len(base) == len(snapshot)
+
+	kind := FrameFull
+	if delta {
+		kind = FrameDelta
+	}
+
+	var lastSequence uint32 = 0
+	if player, ok := gs.Players[playerId]; ok {
+		lastSequence = player.Input.Sequence
+	}
+
+	buf := gs.frameBuffer[:0]
+	buf = append(buf, PROTOCOL_VERSION, kind)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(playerId))
+	buf = binary.LittleEndian.AppendUint32(buf, lastSequence)
+	buf = binary.LittleEndian.AppendUint32(buf, gs.Tick)
+
+	if delta {
+		// Clients acknowledging the same tick share the delta
+		encoded, ok := gs.deltas[ackTick]
+		if !ok {
+			encoded = EncodeDelta(nil, base, snapshot)
+			gs.deltas[ackTick] = encoded
+		}
+
+		buf = binary.LittleEndian.AppendUint32(buf, ackTick)
+		buf = append(buf, encoded...)
+	} else {
+		buf = append(buf, snapshot...)
+	}
+
+	gs.frameBuffer = buf
+	return buf
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// Applies a delta the way clients do, runs of unchanged and changed bytes XORed onto the base
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	snapshot := append([]byte(nil), base...)
+	reader := bytes.NewReader(delta)
+
+	position := 0
+	for reader.Len() > 0 {
+		unchanged, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		position += int(unchanged)
+		if position+int(changed) > len(snapshot) {
+			return nil, errors.New("delta runs past the snapshot")
+		}
+
+		for i := 0; i < int(changed); i++ {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			snapshot[position] ^= b
+			position++
+		}
+	}
+
+	return snapshot, nil
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	cases := map[string][2][]byte{
+		"empty":            {{}, {}},
+		"unchanged":        {{1, 2, 3, 4}, {1, 2, 3, 4}},
+		"all changed":      {{1, 2, 3, 4}, {5, 6, 7, 8}},
+		"first byte":       {{1, 2, 3, 4}, {9, 2, 3, 4}},
+		"last byte":        {{1, 2, 3, 4}, {1, 2, 3, 9}},
+		"runs":             {{0, 0, 0, 0, 0, 0, 0}, {1, 0, 0, 1, 1, 0, 1}},
+		"long unchanged":   {make([]byte, 300), append(make([]byte, 299), 1)},
+		"changed to zero":  {{255, 255, 255}, {0, 255, 0}},
+		"changed from one": {{1, 1, 1, 1}, {1, 0, 0, 1}},
+	}
+
+	for name, pair := range cases {
+		base, snapshot := pair[0], pair[1]
+		decoded, err := applyDelta(base, EncodeDelta(nil, base, snapshot))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(decoded, snapshot) {
+			t.Fatalf("%s: decoded %v, expected %v", name, decoded, snapshot)
+		}
+	}
+}
+
+func TestFramesDecodeToSnapshots(t *testing.T) {
+	rules := RulePresets["multiball"]
+	gs := newTestSession(3, rules)
+
+	var sequence uint32 = 0
+	deltas := 0
+	for tick := 0; tick < 1200; tick++ {
+		if input, ok := testInput(1, gs.Tick, sequence+1); ok {
+			sequence++
+			gs.AddPlayerInput(input)
+		}
+		gs.Step()
+
+		snapshot, ok := gs.Snapshots.Get(gs.Tick)
+		if !ok {
+			t.Fatalf("no snapshot for tick %d", gs.Tick)
+		}
+
+		// Acknowledging a tick a few back, as a client on a slow connection would
+		ackTick := gs.Tick - min(gs.Tick, uint32(tick%SNAPSHOT_HISTORY))
+		frame := gs.Frame(1, ackTick)
+
+		if frame[0] != PROTOCOL_VERSION {
+			t.Fatalf("frame version %d", frame[0])
+		}
+		if playerId := int32(binary.LittleEndian.Uint32(frame[2:])); playerId != 1 {
+			t.Fatalf("frame for player %d", playerId)
+		}
+		if lastSequence := binary.LittleEndian.Uint32(frame[6:]); lastSequence != gs.Players[1].Input.Sequence {
+			t.Fatalf("frame acknowledges sequence %d, applied %d", lastSequence, gs.Players[1].Input.Sequence)
+		}
+		if frameTick := binary.LittleEndian.Uint32(frame[10:]); frameTick != gs.Tick {
+			t.Fatalf("frame for tick %d at tick %d", frameTick, gs.Tick)
+		}
+
+		decoded := frame[14:]
+		if frame[1] == FrameDelta {
+			deltas++
+			baseTick := binary.LittleEndian.Uint32(frame[14:])
+			base, ok := gs.Snapshots.Get(baseTick)
+			if baseTick != ackTick || !ok {
+				t.Fatalf("delta against tick %d, acknowledged %d", baseTick, ackTick)
+			}
+
+			var err error
+			if decoded, err = applyDelta(base, frame[18:]); err != nil {
+				t.Fatalf("tick %d: %s", gs.Tick, err)
+			}
+		}
+
+		if !bytes.Equal(decoded, snapshot) {
+			t.Fatalf("frame at tick %d decodes to\n%v\nexpected\n%v", gs.Tick, decoded, snapshot)
+		}
+	}
+
+	if deltas == 0 {
+		t.Fatalf("no frame was sent as a delta")
+	}
+}
+
+func TestLargestCourtFitsSnapshots(t *testing.T) {
+	rules := RulePresets["classic"]
+	rules.CourtWidth = MAX_COURT_SIZE
+	rules.CourtHeight = MAX_COURT_SIZE
+	rules.MaxBallSpeedFactor = float32(MAX_SNAPSHOT_VELOCITY) / rules.BallSpeed
+	if err := rules.Validate(); err != nil {
+		t.Fatalf("largest rules are invalid: %s", err)
+	}
+
+	// Balls are clamped to a radius outside the court
+	for _, position := range []float32{-BALL_RADIUS, rules.CourtWidth + BALL_RADIUS} {
+		if value := quantize(position, POSITION_SCALE); value == math.MinInt16 || value == math.MaxInt16 {
+			t.Fatalf("position %g saturates", position)
+		}
+	}
+
+	topSpeed := rules.BallSpeed * rules.MaxBallSpeedFactor
+	if value := quantize(topSpeed, VELOCITY_SCALE); float32(value)/VELOCITY_SCALE < topSpeed-1 {
+		t.Fatalf("top speed %g encodes as %d", topSpeed, value)
+	}
+
+	rules.CourtWidth = MAX_COURT_SIZE + 1
+	if rules.Validate() == nil {
+		t.Fatalf("court wider than %d is valid", MAX_COURT_SIZE)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames waiting for a connection, a client that falls further behind loses the oldest ones
+const SEND_QUEUE_SIZE = 8
+
+// Clients that keep losing frames for 2 seconds are disconnected, and can reconnect
+const MAX_DROPPED_FRAMES = uint32(2 * time.Second / SESSION_DELTA_TIME)
+
+const WRITE_TIMEOUT = time.Second
+
+// Connections are pinged once a second, the pong carries the send time back
+const PING_INTERVAL = time.Second
+
+// Connections that neither answer pings nor send anything for this long are taken as gone
+const READ_TIMEOUT = 3 * PING_INTERVAL
+
+type OutgoingMessage struct {
+	Type int
+	Data []byte
+}
+
+// Queues a message without blocking, only called from the session goroutine
+func (pc *PlayerController) Send(messageType int, data []byte) {
+	message := OutgoingMessage{Type: messageType, Data: data}
+
+	select {
+	case pc.Outbox <- message:
+		pc.Dropped = 0
+		return
+	default:
+	}
+
+	// Newer frames replace the oldest, the welcome can not be replaced
+	select {
+	case dropped := <-pc.Outbox:
+		if dropped.Type != websocket.BinaryMessage {
+			pc.Log().Warn("Client did not receive its welcome, disconnecting")
+			pc.HangUp()
+			return
+		}
+	default:
+	}
+
+	select {
+	case pc.Outbox <- message:
+	default:
+	}
+
+	pc.Dropped++
+	if pc.Dropped == MAX_DROPPED_FRAMES {
+		pc.Log().Warn("Client fell behind, disconnecting", "dropped", MAX_DROPPED_FRAMES)
+		pc.HangUp()
+	}
+}
+
+// Writes queued messages and pings until the connection fails or the controller is stopped
+func (pc *PlayerController) Write() {
+	ping := time.NewTicker(PING_INTERVAL)
+	defer ping.Stop()
+
+	// Closing makes the reading side notice a failed write
+	defer pc.HangUp()
+
+	for {
+		var err error
+		select {
+		case message := <-pc.Outbox:
+			pc.Connection.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			err = pc.Connection.WriteMessage(message.Type, message.Data)
+			if err == nil && message.Type == websocket.BinaryMessage {
+				Metrics.FrameBytes.Observe(float64(len(message.Data)))
+			}
+		case <-ping.C:
+			sent := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+			err = pc.Connection.WriteControl(websocket.PingMessage, sent, time.Now().Add(WRITE_TIMEOUT))
+		case <-pc.Done:
+			return
+		}
+
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, websocket.ErrCloseSent) {
+				pc.Log().Warn("Could not write to client", "error", err)
+				Metrics.WriteErrors.Add(1)
+			}
+			return
+		}
+	}
+}
+
+// Ends the writer goroutine, called once the connection is no longer read
+func (pc *PlayerController) Stop() {
+	pc.stop.Do(func() {
+		close(pc.Done)
+	})
+}
+
+// Sends a close frame without waiting for the outbox, control frames can be written alongside the writer
+func (pc *PlayerController) Close(code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	pc.Connection.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
+
+// Closes the connection from this side, the reading goroutine then fails without counting a read error
+func (pc *PlayerController) HangUp() {
+	pc.hungUp.Store(true)
+	pc.Connection.Close()
+}
+
+// Checks if the connection was closed by HangUp rather than by the client or the network
+func (pc *PlayerController) HungUp() bool {
+	return pc.hungUp.Load()
+}
+
+// Pushes the read deadline back, called whenever the peer shows it is still there
+func KeepAlive(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
+}